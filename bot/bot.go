@@ -0,0 +1,282 @@
+// Package bot routes chat commands such as "/deploy prod" or "!status"
+// received by a wechat.Core to handlers.
+//
+//	router := bot.New(core)
+//	router.Use(bot.Recover(nil), bot.Logging(nil))
+//	router.Handle("deploy", "<env>", "deploy to an environment",
+//		func(ctx *bot.Context) error {
+//			return ctx.Reply("deploying " + ctx.Arg(0))
+//		}, bot.AllowSenders("alice-ops")) // a remark or WeChat ID
+//	core.SyncMsgFunc = router.SyncMsgFunc
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/binarycraft007/wechat"
+)
+
+var ErrUnterminatedQuote = errors.New("unterminated quote")
+var ErrMissingArgs = errors.New("missing arguments")
+
+type HandlerFunc func(ctx *Context) error
+
+type Middleware func(next HandlerFunc) HandlerFunc
+
+type command struct {
+	name        string
+	usage       string
+	description string
+	minArgs     int
+	handler     HandlerFunc
+}
+
+type Router struct {
+	Core     *wechat.Core
+	Prefixes []string
+	// NotFound handles unknown commands, they are ignored when nil.
+	NotFound HandlerFunc
+	// ErrorFunc is called with errors returned by handlers, the default
+	// replies with the error text.
+	ErrorFunc  func(ctx *Context, err error)
+	commands   map[string]*command
+	middleware []Middleware
+}
+
+func New(core *wechat.Core) *Router {
+	router := Router{
+		Core:     core,
+		Prefixes: []string{"/", "!"},
+		commands: make(map[string]*command),
+		ErrorFunc: func(ctx *Context, err error) {
+			ctx.Reply("error: " + err.Error())
+		},
+	}
+
+	router.Handle("help", "[command]", "show the available commands",
+		router.helpHandler)
+
+	return &router
+}
+
+// Use adds middleware that runs for every command, in the order given.
+func (router *Router) Use(middleware ...Middleware) {
+	router.middleware = append(router.middleware, middleware...)
+}
+
+// Handle registers a command. Usage documents its arguments for the
+// help, the number of <required> arguments in it is enforced.
+func (router *Router) Handle(name string, usage string, description string,
+	handler HandlerFunc, middleware ...Middleware) {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+
+	router.commands[strings.ToLower(name)] = &command{
+		name:        name,
+		usage:       usage,
+		description: description,
+		minArgs:     strings.Count(usage, "<"),
+		handler:     handler,
+	}
+}
+
+// SyncMsgFunc dispatches every new message, it fits wechat.CoreOption.
+func (router *Router) SyncMsgFunc(data *wechat.SyncResponse) error {
+	for _, message := range data.AddMsgList {
+		router.Dispatch(message)
+	}
+	return nil
+}
+
+// Dispatch runs the command in message and reports whether it was one.
+func (router *Router) Dispatch(message wechat.Message) bool {
+	if wechat.MessageType(message.MsgType) != wechat.Text {
+		return false
+	}
+
+	record := router.Core.NewHistoryRecord(message)
+	if record.Outgoing {
+		return false
+	}
+
+	text := stripMention(record.Text, router.Core.User.NickName)
+
+	var body string
+	for _, prefix := range router.Prefixes {
+		if strings.HasPrefix(text, prefix) {
+			body = strings.TrimPrefix(text, prefix)
+			break
+		}
+	}
+	if len(body) == 0 {
+		return false
+	}
+
+	name := body
+	rawArgs := ""
+	if idx := strings.IndexAny(body, " \t\n\u2005"); idx != -1 {
+		name, rawArgs = body[:idx], strings.TrimSpace(body[idx+1:])
+	}
+
+	ctx := &Context{
+		Core:    router.Core,
+		Message: message,
+		Record:  record,
+		Sender:  senderContact(router.Core, record),
+		Command: strings.ToLower(name),
+		RawArgs: rawArgs,
+	}
+
+	cmd, ok := router.commands[ctx.Command]
+	handler := router.NotFound
+	if ok {
+		handler = cmd.handler
+	}
+	if handler == nil {
+		return false
+	}
+
+	run := router.wrap(func(ctx *Context) error {
+		args, err := ParseArgs(ctx.RawArgs)
+		if err != nil {
+			return err
+		}
+		ctx.Args = args
+
+		if ok && len(args) < cmd.minArgs {
+			return fmt.Errorf("%w, usage: %s", ErrMissingArgs, cmd.help())
+		}
+		return handler(ctx)
+	})
+
+	if err := run(ctx); err != nil && router.ErrorFunc != nil {
+		router.ErrorFunc(ctx, err)
+	}
+
+	return true
+}
+
+func (router *Router) wrap(handler HandlerFunc) HandlerFunc {
+	for i := len(router.middleware) - 1; i >= 0; i-- {
+		handler = router.middleware[i](handler)
+	}
+	return handler
+}
+
+func (cmd *command) help() string {
+	if len(cmd.usage) == 0 {
+		return cmd.name
+	}
+	return cmd.name + " " + cmd.usage
+}
+
+// Help lists the registered commands with their usage.
+func (router *Router) Help() string {
+	var names []string
+	for name := range router.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	prefix := ""
+	if len(router.Prefixes) > 0 {
+		prefix = router.Prefixes[0]
+	}
+
+	var lines []string
+	for _, name := range names {
+		cmd := router.commands[name]
+		line := prefix + cmd.help()
+		if len(cmd.description) > 0 {
+			line += " - " + cmd.description
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (router *Router) helpHandler(ctx *Context) error {
+	if len(ctx.Args) > 0 {
+		cmd, ok := router.commands[strings.ToLower(ctx.Args[0])]
+		if !ok {
+			return fmt.Errorf("unknown command: %s", ctx.Args[0])
+		}
+		text := cmd.help()
+		if len(cmd.description) > 0 {
+			text += "\n" + cmd.description
+		}
+		return ctx.Reply(text)
+	}
+	return ctx.Reply(router.Help())
+}
+
+// stripMention removes a leading "@Bot" so "@Bot /status" is a command.
+func stripMention(text string, nickName string) string {
+	text = strings.TrimSpace(text)
+	if len(nickName) > 0 && strings.HasPrefix(text, "@"+nickName) {
+		text = strings.TrimPrefix(text, "@"+nickName)
+		// The mention is followed by a four-per-em space
+		text = strings.TrimLeft(text, " \u2005")
+	}
+	return text
+}
+
+func senderContact(core *wechat.Core, record wechat.HistoryRecord) wechat.Contact {
+	if contact, ok := core.Contact(record.SenderUserName); ok {
+		return contact
+	}
+
+	chat, _ := core.Contact(record.ChatUserName)
+	for _, member := range chat.MemberList {
+		if member.UserName == record.SenderUserName {
+			return member
+		}
+	}
+
+	return wechat.Contact{
+		UserName: record.SenderUserName,
+		NickName: record.SenderName,
+	}
+}
+
+// ParseArgs splits s at white space, keeping quoted parts together.
+func ParseArgs(s string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	var quote rune
+	inArg := false
+
+	for _, r := range s {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			current.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case r == ' ' || r == '\t' || r == '\n' || r == '\u2005':
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, ErrUnterminatedQuote
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+
+	return args, nil
+}
@@ -0,0 +1,155 @@
+package bot
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/binarycraft007/wechat"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+		err  error
+	}{
+		{"", nil, nil},
+		{"  ", nil, nil},
+		{"prod", []string{"prod"}, nil},
+		{"a  b\tc\nd", []string{"a", "b", "c", "d"}, nil},
+		{"a b", []string{"a", "b"}, nil},
+		{`"two words" x`, []string{"two words", "x"}, nil},
+		{`'it"s' x`, []string{`it"s`, "x"}, nil},
+		{`pre"fix suf"fix`, []string{"prefix suffix"}, nil},
+		{`""`, []string{""}, nil},
+		{`"open`, nil, ErrUnterminatedQuote},
+	}
+
+	for _, test := range tests {
+		got, err := ParseArgs(test.in)
+		if err != test.err || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseArgs(%q) = %q, %v, want %q, %v",
+				test.in, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestRouterDispatch(t *testing.T) {
+	core, err := wechat.New(wechat.CoreOption{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	core.User.UserName = "@me"
+	core.User.NickName = "Bot"
+
+	var ran, failed string
+	record := func(ctx *Context) error {
+		ran = ctx.Command + " " + strings.Join(ctx.Args, ",")
+		return nil
+	}
+
+	router := New(core)
+	router.ErrorFunc = func(ctx *Context, err error) { failed = err.Error() }
+	router.Handle("Deploy", "<env> [version]", "deploy", record)
+	router.Handle("admin", "", "", record, AllowSenders("@boss"))
+
+	tests := []struct {
+		name     string
+		msg      wechat.Message
+		dispatch bool
+		ran      string
+		failed   string
+	}{
+		{"slash", wechat.Message{FromUserName: "@alice", Content: "/deploy prod"},
+			true, "deploy prod", ""},
+		{"bang and case", wechat.Message{FromUserName: "@alice", Content: "!DEPLOY prod 1.2"},
+			true, "deploy prod,1.2", ""},
+		{"group mention", wechat.Message{FromUserName: "@@group",
+			Content: "@alice:<br/>@Bot /deploy \"prod eu\""},
+			true, "deploy prod eu", ""},
+		{"missing args", wechat.Message{FromUserName: "@alice", Content: "/deploy"},
+			true, "", "missing arguments, usage: Deploy <env> [version]"},
+		{"not allowed", wechat.Message{FromUserName: "@alice", Content: "/admin"},
+			true, "", ErrNotAllowed.Error()},
+		{"allowed", wechat.Message{FromUserName: "@boss", Content: "/admin"},
+			true, "admin ", ""},
+		{"unknown", wechat.Message{FromUserName: "@alice", Content: "/nope"},
+			false, "", ""},
+		{"no prefix", wechat.Message{FromUserName: "@alice", Content: "deploy prod"},
+			false, "", ""},
+		{"own message", wechat.Message{FromUserName: "@me", ToUserName: "@alice",
+			Content: "/deploy prod"}, false, "", ""},
+		{"not text", wechat.Message{FromUserName: "@alice", Content: "/deploy prod",
+			MsgType: int(wechat.Image)}, false, "", ""},
+	}
+
+	for _, test := range tests {
+		ran, failed = "", ""
+		if test.msg.MsgType == 0 {
+			test.msg.MsgType = int(wechat.Text)
+		}
+
+		if got := router.Dispatch(test.msg); got != test.dispatch {
+			t.Errorf("%s: Dispatch = %v, want %v", test.name, got, test.dispatch)
+		}
+		if ran != test.ran || failed != test.failed {
+			t.Errorf("%s: ran %q, failed %q, want %q, %q",
+				test.name, ran, failed, test.ran, test.failed)
+		}
+	}
+}
+
+func TestRouterNotFoundAndRecover(t *testing.T) {
+	core, err := wechat.New(wechat.CoreOption{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var failed error
+	router := New(core)
+	router.Use(Recover(nil))
+	router.ErrorFunc = func(ctx *Context, err error) { failed = err }
+	router.NotFound = func(ctx *Context) error {
+		return errors.New("unknown: " + ctx.Command)
+	}
+	router.Handle("panic", "", "", func(ctx *Context) error {
+		panic("boom")
+	})
+
+	msg := wechat.Message{FromUserName: "@alice", MsgType: int(wechat.Text)}
+
+	msg.Content = "/what"
+	if !router.Dispatch(msg) || failed == nil || failed.Error() != "unknown: what" {
+		t.Errorf("not found: %v", failed)
+	}
+
+	msg.Content = "/panic"
+	if !router.Dispatch(msg) || failed == nil || failed.Error() != "command panic failed" {
+		t.Errorf("panic: %v", failed)
+	}
+}
+
+func TestAllowSenders(t *testing.T) {
+	handler := AllowSenders("ops", "alice_id")(func(ctx *Context) error {
+		return nil
+	})
+
+	tests := []struct {
+		name   string
+		sender wechat.Contact
+		want   error
+	}{
+		{"remark", wechat.Contact{UserName: "@1", RemarkName: "ops"}, nil},
+		{"alias", wechat.Contact{UserName: "@2", Alias: "alice_id"}, nil},
+		{"nickname", wechat.Contact{UserName: "@3", NickName: "ops"}, ErrNotAllowed},
+		{"other", wechat.Contact{UserName: "@4"}, ErrNotAllowed},
+	}
+
+	for _, test := range tests {
+		if err := handler(&Context{Sender: test.sender}); err != test.want {
+			t.Errorf("%s: %v, want %v", test.name, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package bot
+
+import (
+	"github.com/binarycraft007/wechat"
+)
+
+type Context struct {
+	Core    *wechat.Core
+	Message wechat.Message
+	// Record holds the chat, the sender and the text without the group
+	// sender prefix.
+	Record  wechat.HistoryRecord
+	Sender  wechat.Contact
+	Command string
+	Args    []string
+	RawArgs string
+}
+
+// Arg returns the i-th argument or an empty string.
+func (ctx *Context) Arg(i int) string {
+	if i < 0 || i >= len(ctx.Args) {
+		return ""
+	}
+	return ctx.Args[i]
+}
+
+// Chat returns the UserName replies are sent to.
+func (ctx *Context) Chat() string {
+	return ctx.Record.ChatUserName
+}
+
+func (ctx *Context) IsGroup() bool {
+	return wechat.IsGroup(ctx.Record.ChatUserName)
+}
+
+func (ctx *Context) Reply(text string) error {
+	return ctx.Core.SendMsg(text, ctx.Chat())
+}
+
+func (ctx *Context) ReplyFile(name string, data []byte) error {
+	return ctx.Core.SendMsg(wechat.MediaMessage{
+		Name:      name,
+		FileBytes: data,
+	}, ctx.Chat())
+}
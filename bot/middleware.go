@@ -0,0 +1,115 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/binarycraft007/wechat"
+)
+
+var ErrNotAllowed = errors.New("not allowed")
+var ErrRateLimited = errors.New("too many commands, try again later")
+
+// AllowSenders only lets senders run the command whose UserName, remark
+// or alias is in names. Nicknames are not matched, anybody can take one.
+func AllowSenders(names ...string) Middleware {
+	allowed := make(map[string]bool)
+	for _, name := range names {
+		allowed[name] = true
+	}
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *Context) error {
+			sender := ctx.Sender
+			for _, name := range []string{
+				sender.UserName,
+				sender.RemarkName,
+				sender.Alias,
+			} {
+				if len(name) > 0 && allowed[name] {
+					return next(ctx)
+				}
+			}
+			return ErrNotAllowed
+		}
+	}
+}
+
+// RateLimit allows every sender at most n commands per period.
+func RateLimit(n int, period time.Duration) Middleware {
+	var mu sync.Mutex
+	calls := make(map[string][]time.Time)
+
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *Context) error {
+			now := time.Now()
+			sender := ctx.Sender.UserName
+
+			mu.Lock()
+			recent := calls[sender][:0]
+			for _, call := range calls[sender] {
+				if now.Sub(call) < period {
+					recent = append(recent, call)
+				}
+			}
+			if len(recent) >= n {
+				calls[sender] = recent
+				mu.Unlock()
+				return ErrRateLimited
+			}
+			calls[sender] = append(recent, now)
+			mu.Unlock()
+
+			return next(ctx)
+		}
+	}
+}
+
+// Logging logs every command with its sender, result and duration, to the
+// Logger of the Core when logger is nil.
+func Logging(logger wechat.Logger) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *Context) error {
+			start := time.Now()
+			err := next(ctx)
+
+			result := "ok"
+			if err != nil {
+				result = err.Error()
+			}
+			loggerOf(ctx, logger).Info("bot command", "command", ctx.Command,
+				"args", ctx.RawArgs, "sender", ctx.Record.SenderName,
+				"chat", ctx.Record.ChatName, "result", result,
+				"took", time.Since(start))
+			return err
+		}
+	}
+}
+
+// Recover turns a panicking handler into an error, logged to the Logger
+// of the Core when logger is nil.
+func Recover(logger wechat.Logger) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *Context) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					loggerOf(ctx, logger).Error("bot command panicked",
+						"command", ctx.Command, "panic", r,
+						"stack", string(debug.Stack()))
+					err = fmt.Errorf("command %s failed", ctx.Command)
+				}
+			}()
+			return next(ctx)
+		}
+	}
+}
+
+func loggerOf(ctx *Context, logger wechat.Logger) wechat.Logger {
+	if logger == nil {
+		return ctx.Core.Logger
+	}
+	return logger
+}
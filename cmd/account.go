@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/binarycraft007/wechat"
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultAccountID names the account of a config without accounts.
+const DefaultAccountID = "default"
+
+// Account is one logged in WeChat user with everything that belongs to its
+// session: persistence, run loop, scheduler and event stream.
+type Account struct {
+	ID        string
+	Core      *wechat.Core
+	Hub       *EventHub
+	Scheduler *Scheduler
+	Metrics   *Metrics
+
+	outbox  *wechat.Outbox
+	history *wechat.History
+
+	throttle      sendThrottle
+	qrRefresh     chan struct{}
+	stopped       chan struct{} // closed when runSessions returns
+	sessionMu     sync.Mutex
+	sessionCancel context.CancelFunc // set while a session syncs
+	logoutResult  chan error         // set when the api asked for a logout
+}
+
+// AccountManager owns the accounts of the config, their set is fixed
+// once the server started.
+type AccountManager struct {
+	accounts []*Account
+	byID     map[string]*Account
+}
+
+var accounts *AccountManager
+
+func newAccountManager(configs []AccountConfig) (*AccountManager, error) {
+	manager := AccountManager{byID: make(map[string]*Account)}
+
+	for _, accountConfig := range configs {
+		account, err := newAccount(accountConfig)
+		if err != nil {
+			manager.Close()
+			return nil, err
+		}
+		manager.accounts = append(manager.accounts, account)
+		manager.byID[account.ID] = account
+	}
+
+	return &manager, nil
+}
+
+func newAccount(accountConfig AccountConfig) (*Account, error) {
+	account := Account{
+		ID:        accountConfig.ID,
+		Hub:       newEventHub(),
+		Metrics:   newMetrics(),
+		qrRefresh: make(chan struct{}, 1),
+		stopped:   make(chan struct{}),
+	}
+
+	var err error
+	if len(accountConfig.OutboxFile) > 0 {
+		if account.outbox, err = wechat.NewOutbox(accountConfig.OutboxFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(accountConfig.HistoryFile) > 0 {
+		if account.history, err = wechat.NewHistory(accountConfig.HistoryFile); err != nil {
+			account.Close()
+			return nil, err
+		}
+		if corrupt := account.history.Corrupt(); corrupt > 0 {
+			logger.Warn("skipped corrupt history lines", "account", account.ID,
+				"file", accountConfig.HistoryFile, "lines", corrupt)
+		}
+	}
+
+	if account.Core, err = wechat.New(wechat.CoreOption{
+		SyncMsgFunc:     account.onMsgRecv,
+		SyncContactFunc: account.onContactSync,
+		LoginStateFunc:  account.onLoginState,
+		Outbox:          account.outbox,
+		History:         account.history,
+		SessionFile:     accountConfig.SessionFile,
+		Metrics:         account.Metrics,
+		Logger:          withArgs(logger, "account", account.ID),
+		RedactLogs:      config.RedactLogs,
+		Images:          config.Images.options(),
+		ProxyURL:        config.HTTP.ProxyURL,
+		UserAgent:       config.HTTP.UserAgent,
+		Timeouts: wechat.Timeouts{
+			SyncCheck: config.HTTP.Timeouts.SyncCheck,
+			SendMsg:   config.HTTP.Timeouts.SendMsg,
+			Upload:    config.HTTP.Timeouts.Upload,
+			Download:  config.HTTP.Timeouts.Download,
+			Default:   config.HTTP.Timeouts.Default,
+		},
+	}); err != nil {
+		account.Close()
+		return nil, err
+	}
+
+	if account.Scheduler, err = newScheduler(&account,
+		accountConfig.ScheduleFile); err != nil {
+		account.Close()
+		return nil, err
+	}
+
+	return &account, nil
+}
+
+// Close releases the files of account.
+func (account *Account) Close() {
+	if account.outbox != nil {
+		account.outbox.Close()
+	}
+	if account.history != nil {
+		account.history.Close()
+	}
+}
+
+func (manager *AccountManager) Get(id string) (*Account, bool) {
+	account, ok := manager.byID[id]
+	return account, ok
+}
+
+// Default is the account served by the routes without /accounts/:account.
+func (manager *AccountManager) Default() *Account {
+	return manager.accounts[0]
+}
+
+func (manager *AccountManager) All() []*Account {
+	return manager.accounts
+}
+
+// Run starts the session loop and the scheduler of every account, they
+// stop with ctx.
+func (manager *AccountManager) Run(ctx context.Context) {
+	for _, account := range manager.accounts {
+		go account.runSessions(ctx) // login from the api, then sync
+		go account.Scheduler.run(ctx)
+	}
+}
+
+// Logout ends the sessions of all logged in accounts once their session
+// loops stopped with the context passed to Run.
+func (manager *AccountManager) Logout() {
+	for _, account := range manager.accounts {
+		<-account.stopped
+		if account.Core.LoginState() != wechat.LoggedIn {
+			continue
+		}
+		if err := account.Core.Logout(); err != nil {
+			logger.Error("logout failed", "account", account.ID, "err", err)
+		}
+	}
+}
+
+func (manager *AccountManager) Close() {
+	for _, account := range manager.accounts {
+		account.Close()
+	}
+}
+
+// accountFile derives the file of an account from the one configured for
+// all of them, session.json becomes session.<id>.json.
+func accountFile(path string, id string) string {
+	if len(path) == 0 {
+		return ""
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + id + ext
+}
+
+// withAccount resolves the account of the request, the default one
+// without /accounts/:account, and checks that the token may use it.
+func withAccount(c *gin.Context) {
+	account := accounts.Default()
+	if id := c.Param("account"); len(id) > 0 {
+		var ok bool
+		if account, ok = accounts.Get(id); !ok {
+			c.AbortWithStatusJSON(http.StatusNotFound, Message{
+				Msg: "account not found: " + id,
+			})
+			return
+		}
+	}
+
+	if !requestToken(c).allowsAccount(account.ID) {
+		c.AbortWithStatusJSON(http.StatusForbidden, Message{
+			Msg: "account not allowed for token: " + account.ID,
+		})
+		return
+	}
+
+	c.Set("account", account)
+}
+
+func accountOf(c *gin.Context) *Account {
+	return c.MustGet("account").(*Account)
+}
+
+func listAccountsHandler(c *gin.Context) {
+	token := requestToken(c)
+	infos := []AccountInfo{}
+	for _, account := range accounts.All() {
+		if !token.allowsAccount(account.ID) {
+			continue
+		}
+		status := account.Core.Status()
+		infos = append(infos, AccountInfo{
+			ID:       account.ID,
+			State:    loginStates[status.LoginState],
+			NickName: status.User.NickName,
+		})
+	}
+	c.IndentedJSON(http.StatusOK, infos)
+}
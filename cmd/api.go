@@ -2,65 +2,114 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"io/ioutil"
-	"log"
 	"net/http"
-	"strings"
+	"strconv"
+	"time"
 
 	"github.com/binarycraft007/wechat"
+	"github.com/binarycraft007/wechat/export"
 	"github.com/gin-gonic/gin"
 )
 
 func initAllApiHanlders(engine *gin.Engine) {
-	engine.GET("/demo", demoHandler)
-	engine.POST("/sendmsg", sendMsgHandler)
-	engine.POST("/sendfile", sendFileHandler)
+	engine.GET("/healthz", healthzHandler)
+	engine.GET("/readyz", readyzHandler)
+	engine.GET("/accounts/:account/healthz", withAccount, accountHealthzHandler)
+	engine.GET("/accounts/:account/readyz", withAccount, accountReadyzHandler)
+	engine.GET("/metrics", requireScope(ScopeAdmin), metricsHandler)
+	engine.GET("/accounts", requireScope(ScopeReadContacts), listAccountsHandler)
+
+	// Routes without an account act for the default one
+	initAccountHandlers(engine)
+	initAccountHandlers(engine.Group("/accounts/:account"))
+}
+
+func initAccountHandlers(routes gin.IRoutes) {
+	route := func(method string, path string, scope string, handler gin.HandlerFunc) {
+		routes.Handle(method, path, requireScope(scope), withAccount, handler)
+	}
+	streamRoute := func(path string, handler gin.HandlerFunc) {
+		routes.Handle("GET", path, requireStreamScope(ScopeReadEvents),
+			withAccount, handler)
+	}
+
+	route("GET", "/demo", ScopeAdmin, demoHandler)
+	route("POST", "/sendmsg", ScopeSendText, sendMsgHandler)
+	route("POST", "/sendfile", ScopeSendFile, sendFileHandler)
+	route("GET", "/history", ScopeReadEvents, historyHandler)
+	route("GET", "/history/export", ScopeReadEvents, exportHandler)
+	route("GET", "/media/:msgid", ScopeReadEvents, mediaHandler)
+	streamRoute("/events", sseHandler)
+	streamRoute("/events/ws", wsHandler)
+	route("GET", "/contacts", ScopeReadContacts, listContactsHandler)
+	route("GET", "/contacts/:username", ScopeReadContacts, getContactHandler)
+	route("GET", "/groups/:username/members", ScopeReadContacts, listMembersHandler)
+	route("GET", "/me", ScopeReadContacts, meHandler)
+	route("GET", "/login/qr.png", ScopeAdmin, loginQrHandler)
+	route("GET", "/login/status", ScopeAdmin, loginStatusHandler)
+	route("POST", "/logout", ScopeAdmin, logoutHandler)
+	route("POST", "/schedules", ScopeSendText, createScheduleHandler)
+	route("GET", "/schedules", ScopeSendText, listSchedulesHandler)
+	route("GET", "/schedules/:id", ScopeSendText, getScheduleHandler)
+	route("DELETE", "/schedules/:id", ScopeSendText, deleteScheduleHandler)
 }
 
 func demoHandler(c *gin.Context) {
-	to := "filehelper"
+	account := accountOf(c)
+	core := account.Core
+	to := config.DemoTarget
 	msg := "message sent by wechat bot"
-	if err := core.SendMsg(msg, to); err != nil {
-		log.Println("Send message error:", err)
+	err := core.SendMsg(msg, to)
+	auditSend(account, tokenName(requestToken(c)), c.ClientIP(), "text", to, err)
+	if err != nil {
+		logger.Error("demo send failed", "chat", to, "err", err)
 	}
 
 	pngBytes, err := ioutil.ReadFile("media/zero.png")
 	if err != nil {
-		log.Println("Read file error:", err)
+		logger.Error("demo read failed", "err", err)
 	}
 
 	msgPng := wechat.MediaMessage{
 		Name:      "zero.png",
 		FileBytes: pngBytes,
 	}
-	if err := core.SendMsg(msgPng, to); err != nil {
-		log.Println("Send message error:", err)
+	err = core.SendMsg(msgPng, to)
+	auditSend(account, tokenName(requestToken(c)), c.ClientIP(), "file", to, err)
+	if err != nil {
+		logger.Error("demo send failed", "chat", to, "err", err)
 	}
 
 	mp4Bytes, err := ioutil.ReadFile("media/gopher.mp4")
 	if err != nil {
-		log.Println("Read file error:", err)
+		logger.Error("demo read failed", "err", err)
 	}
 
 	msgMp4 := wechat.MediaMessage{
 		Name:      "gopher.mp4",
 		FileBytes: mp4Bytes,
 	}
-	if err := core.SendMsg(msgMp4, to); err != nil {
-		log.Println("Send message error:", err)
+	err = core.SendMsg(msgMp4, to)
+	auditSend(account, tokenName(requestToken(c)), c.ClientIP(), "file", to, err)
+	if err != nil {
+		logger.Error("demo send failed", "chat", to, "err", err)
 	}
 
 	txtBytes, err := ioutil.ReadFile("media/hello.txt")
 	if err != nil {
-		log.Println("Read file error:", err)
+		logger.Error("demo read failed", "err", err)
 	}
 
 	msgTxt := wechat.MediaMessage{
 		Name:      "hello.txt",
 		FileBytes: txtBytes,
 	}
-	if err := core.SendMsg(msgTxt, to); err != nil {
-		log.Println("Send message error:", err)
+	err = core.SendMsg(msgTxt, to)
+	auditSend(account, tokenName(requestToken(c)), c.ClientIP(), "file", to, err)
+	if err != nil {
+		logger.Error("demo send failed", "chat", to, "err", err)
 	}
 
 	c.IndentedJSON(http.StatusOK, Message{Msg: "success"})
@@ -76,42 +125,60 @@ func sendMsgHandler(c *gin.Context) {
 		return
 	}
 
-	if len(sendMsgReq.TextMsg) == 0 || len(sendMsgReq.NickName) == 0 {
+	if len(sendMsgReq.TextMsg) == 0 {
 		c.IndentedJSON(http.StatusBadRequest, Message{
 			Msg: "bad request",
 		})
 		return
 	}
 
-	var to string
-	for _, contact := range core.ContactMap {
-		if strings.Contains(contact.NickName, sendMsgReq.NickName) {
-			to = contact.UserName
-			break
-		}
+	results, err := selectRecipients(accountOf(c).Core, sendMsgReq,
+		requestToken(c))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, Message{
+			Msg: err.Error(),
+		})
+		return
 	}
 
-	if len(to) == 0 {
-		c.IndentedJSON(http.StatusNotFound, Message{
-			Msg: "contact not found: " + sendMsgReq.NickName,
+	sendToRecipients(c, "text", sendMsgReq.TextMsg, results)
+}
+
+func sendFileHandler(c *gin.Context) {
+	file, header, err := c.Request.FormFile("file")
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, Message{
+			Msg: err.Error(),
 		})
 		return
 	}
 
-	if len(sendMsgReq.TextMsg) > 0 {
-		if err := core.SendMsg(sendMsgReq.TextMsg, to); err != nil {
-			c.IndentedJSON(http.StatusInternalServerError, Message{
-				Msg: err.Error(),
+	sendMsgReq := SendMessageRequest{
+		NickName: c.Request.PostFormValue("NickName"),
+		Tag:      c.Request.PostFormValue("Tag"),
+	}
+
+	if to := c.Request.PostFormValue("To"); len(to) > 0 {
+		if err := json.Unmarshal([]byte(to), &sendMsgReq.To); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, Message{
+				Msg: "To: " + err.Error(),
 			})
 			return
 		}
 	}
 
-	c.IndentedJSON(http.StatusOK, Message{Msg: "success"})
-}
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(file)
 
-func sendFileHandler(c *gin.Context) {
-	file, header, err := c.Request.FormFile("file")
+	if len(buf.Bytes()) == 0 {
+		c.IndentedJSON(http.StatusBadRequest, Message{
+			Msg: "empty file",
+		})
+		return
+	}
+
+	results, err := selectRecipients(accountOf(c).Core, sendMsgReq,
+		requestToken(c))
 	if err != nil {
 		c.IndentedJSON(http.StatusBadRequest, Message{
 			Msg: err.Error(),
@@ -119,36 +186,132 @@ func sendFileHandler(c *gin.Context) {
 		return
 	}
 
-	nickName := c.Request.PostFormValue("NickName")
+	// AsFile sends images as they are, without preparing them
+	asFile, _ := strconv.ParseBool(c.Request.PostFormValue("AsFile"))
 
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(file)
+	sendToRecipients(c, "file", wechat.MediaMessage{
+		Name:      header.Filename,
+		FileBytes: buf.Bytes(),
+		AsFile:    asFile,
+	}, results)
+}
 
-	var to string
-	for _, contact := range core.ContactMap {
-		if strings.Contains(contact.NickName, nickName) {
-			to = contact.UserName
-			break
+func historyHandler(c *gin.Context) {
+	core := accountOf(c).Core
+	if core.History == nil {
+		c.IndentedJSON(http.StatusNotFound, Message{
+			Msg: "history disabled",
+		})
+		return
+	}
+
+	query := wechat.HistoryQuery{
+		Chat:    c.Query("chat"),
+		Sender:  c.Query("sender"),
+		Keyword: c.Query("keyword"),
+	}
+
+	var err error
+	if since := c.Query("since"); len(since) > 0 {
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, Message{Msg: err.Error()})
+			return
+		}
+	}
+
+	if until := c.Query("until"); len(until) > 0 {
+		if query.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, Message{Msg: err.Error()})
+			return
+		}
+	}
+
+	if msgType := c.Query("type"); len(msgType) > 0 {
+		value, err := strconv.Atoi(msgType)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, Message{Msg: err.Error()})
+			return
+		}
+		query.MsgType = wechat.MessageType(value)
+	}
+
+	if limit := c.Query("limit"); len(limit) > 0 {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, Message{Msg: err.Error()})
+			return
 		}
 	}
 
-	if len(to) == 0 {
+	c.IndentedJSON(http.StatusOK, core.History.Search(query))
+}
+
+func exportHandler(c *gin.Context) {
+	core := accountOf(c).Core
+	if core.History == nil {
 		c.IndentedJSON(http.StatusNotFound, Message{
-			Msg: "contact not found: " + nickName,
+			Msg: "history disabled",
 		})
 		return
 	}
 
-	if len(buf.Bytes()) > 0 {
-		if err := core.SendMsg(wechat.MediaMessage{
-			Name:      header.Filename,
-			FileBytes: buf.Bytes(),
-		}, to); err != nil {
-			c.IndentedJSON(http.StatusInternalServerError, Message{
-				Msg: err.Error(),
-			})
-			return
-		}
+	records := core.History.Search(wechat.HistoryQuery{
+		Chat: c.Query("chat"),
+	})
+	missed := 0
+	options := export.Options{
+		Title: c.Query("chat"),
+		Core:  core,
+		ImageMissed: func(entry export.Entry, err error) {
+			missed++
+			logger.Debug("export image missing", "msgid", entry.MsgID,
+				"err", err)
+		},
 	}
-	c.IndentedJSON(http.StatusOK, Message{Msg: "success"})
+
+	var err error
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		c.Header("Content-Type", "application/x-ndjson; charset=utf-8")
+		err = export.JSONLines(c.Writer, records, options)
+	case "html":
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		err = export.HTML(c.Writer, records, options)
+	case "text":
+		c.Header("Content-Type", "text/plain; charset=utf-8")
+		err = export.Text(c.Writer, records, options)
+	default:
+		c.IndentedJSON(http.StatusBadRequest, Message{
+			Msg: "unknown format: " + c.Query("format"),
+		})
+		return
+	}
+
+	if err != nil {
+		logger.Error("export failed", "err", err)
+	}
+	if missed > 0 {
+		logger.Warn("export without some images", "account",
+			accountOf(c).ID, "missing", missed)
+	}
+}
+
+func mediaHandler(c *gin.Context) {
+	msgType, err := strconv.Atoi(c.Query("type"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, Message{Msg: err.Error()})
+		return
+	}
+
+	data, err := accountOf(c).Core.DownloadMedia(c.Param("msgid"),
+		wechat.MessageType(msgType))
+	if err == wechat.ErrInvalidMsgType {
+		c.IndentedJSON(http.StatusBadRequest, Message{Msg: err.Error()})
+		return
+	}
+	if err != nil {
+		c.IndentedJSON(http.StatusBadGateway, Message{Msg: err.Error()})
+		return
+	}
+
+	c.Data(http.StatusOK, http.DetectContentType(data), data)
 }
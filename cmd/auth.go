@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/binarycraft007/wechat"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ScopeSendText     = "send-text"
+	ScopeSendFile     = "send-file"
+	ScopeReadContacts = "read-contacts"
+	ScopeReadEvents   = "read-events"
+	ScopeAdmin        = "admin"
+)
+
+type Token struct {
+	Name       string   `yaml:"name"`
+	Token      string   `yaml:"token"`
+	Scopes     []string `yaml:"scopes"`
+	Recipients []string `yaml:"recipients"` // empty allows everybody
+	Accounts   []string `yaml:"accounts"`   // empty allows all of them
+}
+
+var tokens []Token
+
+// insecureNoAuth lets requests through when there are no tokens, otherwise
+// every request is rejected then.
+var insecureNoAuth bool
+
+func validateTokens(tokens []Token) error {
+	names := make(map[string]bool)
+	for i, token := range tokens {
+		if len(token.Name) == 0 {
+			return fmt.Errorf("token #%d: name is empty", i+1)
+		}
+		if names[token.Name] {
+			return fmt.Errorf("token %q: duplicate name", token.Name)
+		}
+		names[token.Name] = true
+
+		if len(token.Token) < 16 {
+			return fmt.Errorf("token %q: token shorter than 16 characters",
+				token.Name)
+		}
+
+		for _, scope := range token.Scopes {
+			switch scope {
+			case ScopeSendText, ScopeSendFile, ScopeReadContacts,
+				ScopeReadEvents, ScopeAdmin:
+			default:
+				return fmt.Errorf("token %q: unknown scope %q",
+					token.Name, scope)
+			}
+		}
+	}
+	return nil
+}
+
+func (token *Token) hasScope(scope string) bool {
+	for _, s := range token.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether the token may send to contact. Nicknames are not
+// matched, every contact can rename themselves to an allowed one.
+func (token *Token) allows(contact wechat.Contact) bool {
+	if token == nil || len(token.Recipients) == 0 {
+		return true
+	}
+
+	for _, recipient := range token.Recipients {
+		if recipient == contact.UserName ||
+			(len(contact.RemarkName) > 0 && recipient == contact.RemarkName) ||
+			(len(contact.Alias) > 0 && recipient == contact.Alias) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsAccount reports whether the token may act for the account id.
+func (token *Token) allowsAccount(id string) bool {
+	if token == nil || len(token.Accounts) == 0 {
+		return true
+	}
+
+	for _, account := range token.Accounts {
+		if account == id {
+			return true
+		}
+	}
+	return false
+}
+
+func findToken(secret string) *Token {
+	var found *Token
+	for i := range tokens {
+		// Compare all of them to not leak which token came close
+		if subtle.ConstantTimeCompare(
+			[]byte(tokens[i].Token), []byte(secret)) == 1 {
+			found = &tokens[i]
+		}
+	}
+	return found
+}
+
+// requireScope rejects requests without a bearer token granting scope.
+func requireScope(scope string) gin.HandlerFunc {
+	return authorize(scope, false)
+}
+
+// requireStreamScope works like requireScope but also takes the token
+// from ?access_token=, for event streams of browsers, which can not set
+// headers on EventSource and WebSocket. Query strings end up in access
+// logs, so no other route accepts it.
+func requireStreamScope(scope string) gin.HandlerFunc {
+	return authorize(scope, true)
+}
+
+func authorize(scope string, queryToken bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(tokens) == 0 && insecureNoAuth {
+			return
+		}
+
+		var secret string
+		if queryToken {
+			secret = c.Query("access_token")
+		}
+		if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+			secret = strings.TrimPrefix(header, "Bearer ")
+		}
+
+		token := findToken(secret)
+		if token == nil {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, Message{
+				Msg: "unauthorized",
+			})
+			return
+		}
+
+		if !token.hasScope(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, Message{
+				Msg: "token lacks scope: " + scope,
+			})
+			return
+		}
+
+		c.Set("token", token)
+	}
+}
+
+func requestToken(c *gin.Context) *Token {
+	if value, ok := c.Get("token"); ok {
+		return value.(*Token)
+	}
+	return nil
+}
+
+func tokenName(token *Token) string {
+	if token == nil {
+		return "anonymous"
+	}
+	return token.Name
+}
+
+func auditSend(account *Account, identity string, remote string, kind string, to string, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error: " + err.Error()
+	}
+
+	logger.Info("audit", "account", account.ID, "token", identity,
+		"remote", remote, "kind", kind, "to", to,
+		"name", account.Core.DisplayName(to), "result", result)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/binarycraft007/wechat"
+	"github.com/gin-gonic/gin"
+)
+
+func TestAuthorize(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	defer func(saved []Token, insecure bool) {
+		tokens, insecureNoAuth = saved, insecure
+	}(tokens, insecureNoAuth)
+
+	const secret = "0123456789abcdef"
+	router := gin.New()
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	router.GET("/contacts", requireScope(ScopeReadContacts), ok)
+	router.GET("/events", requireStreamScope(ScopeReadEvents), ok)
+
+	tests := []struct {
+		name     string
+		tokens   []Token
+		insecure bool
+		path     string
+		header   string
+		want     int
+	}{
+		{"no tokens", nil, false, "/contacts", "", http.StatusUnauthorized},
+		{"no tokens, insecure", nil, true, "/contacts", "", http.StatusOK},
+		{"bearer", []Token{{Name: "a", Token: secret, Scopes: []string{ScopeReadContacts}}},
+			false, "/contacts", "Bearer " + secret, http.StatusOK},
+		{"wrong scope", []Token{{Name: "a", Token: secret, Scopes: []string{ScopeSendText}}},
+			false, "/contacts", "Bearer " + secret, http.StatusForbidden},
+		{"query outside streams", []Token{{Name: "a", Token: secret, Scopes: []string{ScopeAdmin}}},
+			false, "/contacts?access_token=" + secret, "", http.StatusUnauthorized},
+		{"query on stream", []Token{{Name: "a", Token: secret, Scopes: []string{ScopeReadEvents}}},
+			false, "/events?access_token=" + secret, "", http.StatusOK},
+		{"insecure ignored with tokens", []Token{{Name: "a", Token: secret}},
+			true, "/contacts", "", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		tokens, insecureNoAuth = test.tokens, test.insecure
+
+		req := httptest.NewRequest("GET", test.path, nil)
+		if len(test.header) > 0 {
+			req.Header.Set("Authorization", test.header)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != test.want {
+			t.Errorf("%s: status %d, want %d", test.name, w.Code, test.want)
+		}
+	}
+}
+
+func TestTokenAllows(t *testing.T) {
+	token := Token{Recipients: []string{"filehelper", "Alice", "bob_id"}}
+
+	tests := []struct {
+		name    string
+		contact wechat.Contact
+		want    bool
+	}{
+		{"username", wechat.Contact{UserName: "filehelper"}, true},
+		{"remark", wechat.Contact{UserName: "@1", RemarkName: "Alice"}, true},
+		{"alias", wechat.Contact{UserName: "@2", Alias: "bob_id"}, true},
+		{"nickname", wechat.Contact{UserName: "@3", NickName: "Alice"}, false},
+		{"other", wechat.Contact{UserName: "@4", RemarkName: "Carol"}, false},
+	}
+
+	for _, test := range tests {
+		if got := token.allows(test.contact); got != test.want {
+			t.Errorf("%s: allows = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
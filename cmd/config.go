@@ -0,0 +1,585 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/binarycraft007/wechat"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Listen       string                 `yaml:"listen"`
+	PublicURL    string                 `yaml:"public_url"`
+	TLS          TLSConfig              `yaml:"tls"`
+	SyncInterval time.Duration          `yaml:"sync_interval"`
+	SessionFile  string                 `yaml:"session_file"`
+	OutboxFile   string                 `yaml:"outbox_file"`
+	HistoryFile  string                 `yaml:"history_file"`
+	ScheduleFile string                 `yaml:"schedule_file"`
+	LogLevel     string                 `yaml:"log_level"`
+	RedactLogs   bool                   `yaml:"redact_logs"`
+	DemoTarget   string                 `yaml:"demo_target"`
+	SendInterval time.Duration          `yaml:"send_interval"`
+	Tags         map[string][]Recipient `yaml:"tags"`
+	Webhooks     WebhookConfig          `yaml:"webhooks"`
+	Tokens       []Token                `yaml:"tokens"`
+	AutoReply    AutoReplyConfig        `yaml:"auto_reply"`
+	Health       HealthConfig           `yaml:"health"`
+	HTTP         HTTPConfig             `yaml:"http"`
+	Accounts     []AccountConfig        `yaml:"accounts"`
+	Notify       NotifyConfig           `yaml:"notify"`
+	Images       ImagesConfig           `yaml:"images"`
+	// InsecureNoAuth serves the api to everybody when no tokens are
+	// configured, without it the server refuses to start then.
+	InsecureNoAuth bool `yaml:"insecure_no_auth"`
+}
+
+// AccountConfig is one account served by the process. Files left empty
+// are derived from the top level ones, see accountFile.
+type AccountConfig struct {
+	ID           string `yaml:"id"`
+	SessionFile  string `yaml:"session_file"`
+	OutboxFile   string `yaml:"outbox_file"`
+	HistoryFile  string `yaml:"history_file"`
+	ScheduleFile string `yaml:"schedule_file"`
+}
+
+type TLSConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+type WebhookConfig struct {
+	URLs    []string `yaml:"urls"`
+	Secret  string   `yaml:"secret"`
+	Retries int      `yaml:"retries"`
+	Reply   bool     `yaml:"reply"`
+}
+
+type AutoReplyConfig struct {
+	PingReply string `yaml:"ping_reply"` // empty disables it
+	RulesFile string `yaml:"rules_file"` // reloaded when it changes
+	Rules     []Rule `yaml:"rules"`
+}
+
+type HealthConfig struct {
+	MaxSyncAge    time.Duration `yaml:"max_sync_age"`    // since the last sync check
+	MaxSyncErrors int           `yaml:"max_sync_errors"` // in a row
+	MaxLoginWait  time.Duration `yaml:"max_login_wait"`  // not logged in, 0 waits forever
+}
+
+// NotifyConfig is where an operator is told that an account needs a
+// qrcode scanned, every channel set is used.
+type NotifyConfig struct {
+	WebhookURL string     `yaml:"webhook_url"`
+	File       string     `yaml:"file"` // appended to, one json line each
+	SMTP       SMTPConfig `yaml:"smtp"`
+}
+
+// SMTPConfig sends mail through a local relay, without authentication.
+type SMTPConfig struct {
+	Addr string   `yaml:"addr"`
+	From string   `yaml:"from"`
+	To   []string `yaml:"to"`
+}
+
+// ImagesConfig prepares images before upload, see wechat.ImageOptions.
+type ImagesConfig struct {
+	Enabled      bool   `yaml:"enabled"`
+	MaxDimension int    `yaml:"max_dimension"`
+	MaxBytes     int    `yaml:"max_bytes"`
+	Format       string `yaml:"format"`
+	Quality      int    `yaml:"quality"`
+	MaxPixels    int    `yaml:"max_pixels"`
+}
+
+func (conf ImagesConfig) options() *wechat.ImageOptions {
+	if !conf.Enabled {
+		return nil
+	}
+	return &wechat.ImageOptions{
+		MaxDimension: conf.MaxDimension,
+		MaxBytes:     conf.MaxBytes,
+		Format:       wechat.ImageFormat(conf.Format),
+		Quality:      conf.Quality,
+		MaxPixels:    conf.MaxPixels,
+	}
+}
+
+// HTTPConfig is how the wechat servers are reached, zero timeouts keep
+// the defaults of the library.
+type HTTPConfig struct {
+	ProxyURL  string `yaml:"proxy_url"`
+	UserAgent string `yaml:"user_agent"`
+	Timeouts  struct {
+		SyncCheck time.Duration `yaml:"sync_check"`
+		SendMsg   time.Duration `yaml:"send_msg"`
+		Upload    time.Duration `yaml:"upload"`
+		Download  time.Duration `yaml:"download"`
+		Default   time.Duration `yaml:"default"`
+	} `yaml:"timeouts"`
+}
+
+var config *Config
+
+func defaultConfig() *Config {
+	return &Config{
+		Listen:       ":8080",
+		PublicURL:    "http://localhost:8080",
+		SyncInterval: 20 * time.Millisecond,
+		SessionFile:  "session.json",
+		OutboxFile:   "outbox.jsonl",
+		HistoryFile:  "history.jsonl",
+		ScheduleFile: "schedules.json",
+		LogLevel:     "info",
+		DemoTarget:   "filehelper",
+		SendInterval: time.Second,
+		Webhooks:     WebhookConfig{Retries: 3},
+		AutoReply:    AutoReplyConfig{PingReply: "What can I do for you?"},
+		Health: HealthConfig{
+			MaxSyncAge:    2 * time.Minute,
+			MaxSyncErrors: 10,
+			MaxLoginWait:  30 * time.Minute,
+		},
+	}
+}
+
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+// parseToken reads a token given as name:token:scope+scope, limits to
+// recipients and accounts can only be set in the config file.
+func parseToken(value string) (Token, error) {
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) != 3 {
+		// Not quoted, the value may be a bare secret
+		return Token{}, errors.New("token is not name:token:scopes")
+	}
+	return Token{
+		Name:   parts[0],
+		Token:  parts[1],
+		Scopes: strings.Split(parts[2], "+"),
+	}, nil
+}
+
+func parseTokens(values []string) ([]Token, error) {
+	var tokens []Token
+	for _, value := range values {
+		if value = strings.TrimSpace(value); len(value) == 0 {
+			continue
+		}
+		token, err := parseToken(value)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// loadConfig builds the configuration from, in increasing priority, the
+// defaults, the config file, WECHAT_* environment variables and flags.
+func loadConfig(args []string) (*Config, error) {
+	flags := flag.NewFlagSet("wechat", flag.ContinueOnError)
+
+	var webhookURLs, tokenList stringList
+	configFile := flags.String("config", os.Getenv("WECHAT_CONFIG"), "yaml config file")
+	listen := flags.String("listen", "", "address the api listens on")
+	publicURL := flags.String("public-url", "", "base url of media links")
+	tlsCert := flags.String("tls-cert", "", "tls certificate file")
+	tlsKey := flags.String("tls-key", "", "tls key file")
+	syncInterval := flags.Duration("sync-interval", 0, "delay between sync checks")
+	sessionFile := flags.String("session-file", "", "where the session is persisted")
+	outboxFile := flags.String("outbox-file", "", "where unsent messages are kept")
+	historyFile := flags.String("history-file", "", "where incoming and outgoing messages are logged")
+	demoTarget := flags.String("demo-target", "", "recipient of the demo message")
+	pingReply := flags.String("ping-reply", "", "reply to ping, empty disables it")
+	rulesFile := flags.String("rules-file", "", "auto reply rules file")
+	insecureNoAuth := flags.Bool("insecure-no-auth", false, "serve the api without tokens")
+	proxyURL := flags.String("proxy", "", "proxy url for requests to wechat")
+	logLevel := flags.String("log-level", "", "debug, info, warn or error")
+	webhookSecret := flags.String("webhook-secret", "", "key to sign webhook payloads with")
+	webhookRetries := flags.Int("webhook-retries", 0, "retries of a failed webhook delivery")
+	webhookReply := flags.Bool("webhook-reply", false, "send replies returned by webhooks")
+	flags.Var(&webhookURLs, "webhook", "url to post events to, can be repeated")
+	flags.Var(&tokenList, "token", "api token as name:token:scope+scope, can be repeated")
+
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	conf := defaultConfig()
+
+	if len(*configFile) > 0 {
+		data, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			return nil, fmt.Errorf("config: %w", err)
+		}
+
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(conf); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("config: %s: %w", *configFile, err)
+		}
+	}
+
+	if err := conf.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	var flagErr error
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			conf.Listen = *listen
+		case "public-url":
+			conf.PublicURL = *publicURL
+		case "tls-cert":
+			conf.TLS.Cert = *tlsCert
+		case "tls-key":
+			conf.TLS.Key = *tlsKey
+		case "sync-interval":
+			conf.SyncInterval = *syncInterval
+		case "session-file":
+			conf.SessionFile = *sessionFile
+		case "outbox-file":
+			conf.OutboxFile = *outboxFile
+		case "history-file":
+			conf.HistoryFile = *historyFile
+		case "demo-target":
+			conf.DemoTarget = *demoTarget
+		case "ping-reply":
+			conf.AutoReply.PingReply = *pingReply
+		case "rules-file":
+			conf.AutoReply.RulesFile = *rulesFile
+		case "insecure-no-auth":
+			conf.InsecureNoAuth = *insecureNoAuth
+		case "token":
+			conf.Tokens, flagErr = parseTokens(tokenList)
+		case "proxy":
+			conf.HTTP.ProxyURL = *proxyURL
+		case "log-level":
+			conf.LogLevel = *logLevel
+		case "webhook":
+			conf.Webhooks.URLs = webhookURLs
+		case "webhook-secret":
+			conf.Webhooks.Secret = *webhookSecret
+		case "webhook-retries":
+			conf.Webhooks.Retries = *webhookRetries
+		case "webhook-reply":
+			conf.Webhooks.Reply = *webhookReply
+		}
+	})
+	if flagErr != nil {
+		return nil, fmt.Errorf("config: -token: %w", flagErr)
+	}
+
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+
+	return conf, nil
+}
+
+func (conf *Config) applyEnv() error {
+	strs := map[string]*string{
+		"WECHAT_LISTEN":         &conf.Listen,
+		"WECHAT_PUBLIC_URL":     &conf.PublicURL,
+		"WECHAT_TLS_CERT":       &conf.TLS.Cert,
+		"WECHAT_TLS_KEY":        &conf.TLS.Key,
+		"WECHAT_SESSION_FILE":   &conf.SessionFile,
+		"WECHAT_OUTBOX_FILE":    &conf.OutboxFile,
+		"WECHAT_HISTORY_FILE":   &conf.HistoryFile,
+		"WECHAT_DEMO_TARGET":    &conf.DemoTarget,
+		"WECHAT_PING_REPLY":     &conf.AutoReply.PingReply,
+		"WECHAT_RULES_FILE":     &conf.AutoReply.RulesFile,
+		"WECHAT_PROXY":          &conf.HTTP.ProxyURL,
+		"WECHAT_LOG_LEVEL":      &conf.LogLevel,
+		"WECHAT_WEBHOOK_SECRET": &conf.Webhooks.Secret,
+	}
+	for name, value := range strs {
+		if env, ok := os.LookupEnv(name); ok {
+			*value = env
+		}
+	}
+
+	if env, ok := os.LookupEnv("WECHAT_SYNC_INTERVAL"); ok {
+		interval, err := time.ParseDuration(env)
+		if err != nil {
+			return fmt.Errorf("config: WECHAT_SYNC_INTERVAL: %w", err)
+		}
+		conf.SyncInterval = interval
+	}
+
+	if env, ok := os.LookupEnv("WECHAT_WEBHOOKS"); ok {
+		conf.Webhooks.URLs = nil
+		for _, url := range strings.Split(env, ",") {
+			if url = strings.TrimSpace(url); len(url) > 0 {
+				conf.Webhooks.URLs = append(conf.Webhooks.URLs, url)
+			}
+		}
+	}
+
+	if env, ok := os.LookupEnv("WECHAT_WEBHOOK_RETRIES"); ok {
+		retries, err := strconv.Atoi(env)
+		if err != nil {
+			return fmt.Errorf("config: WECHAT_WEBHOOK_RETRIES: %w", err)
+		}
+		conf.Webhooks.Retries = retries
+	}
+
+	if env, ok := os.LookupEnv("WECHAT_TOKENS"); ok {
+		tokens, err := parseTokens(strings.Split(env, ","))
+		if err != nil {
+			return fmt.Errorf("config: WECHAT_TOKENS: %w", err)
+		}
+		conf.Tokens = tokens
+	}
+
+	if env, ok := os.LookupEnv("WECHAT_INSECURE_NO_AUTH"); ok {
+		insecure, err := strconv.ParseBool(env)
+		if err != nil {
+			return fmt.Errorf("config: WECHAT_INSECURE_NO_AUTH: %w", err)
+		}
+		conf.InsecureNoAuth = insecure
+	}
+
+	return nil
+}
+
+var reAccountID = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// accounts returns the configured accounts with their files filled in, or
+// the default account using the top level files when there are none.
+func (conf *Config) accounts() []AccountConfig {
+	if len(conf.Accounts) == 0 {
+		return []AccountConfig{{
+			ID:           DefaultAccountID,
+			SessionFile:  conf.SessionFile,
+			OutboxFile:   conf.OutboxFile,
+			HistoryFile:  conf.HistoryFile,
+			ScheduleFile: conf.ScheduleFile,
+		}}
+	}
+
+	accounts := make([]AccountConfig, len(conf.Accounts))
+	for i, account := range conf.Accounts {
+		fill := func(file *string, path string) {
+			if len(*file) == 0 {
+				*file = accountFile(path, account.ID)
+			}
+		}
+		fill(&account.SessionFile, conf.SessionFile)
+		fill(&account.OutboxFile, conf.OutboxFile)
+		fill(&account.HistoryFile, conf.HistoryFile)
+		fill(&account.ScheduleFile, conf.ScheduleFile)
+		accounts[i] = account
+	}
+	return accounts
+}
+
+func (conf *Config) validate() error {
+	var errs []string
+	invalid := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(conf.Listen); err != nil {
+		invalid("listen: %q is not a host:port address", conf.Listen)
+	}
+
+	if u, err := url.Parse(conf.PublicURL); err != nil ||
+		(u.Scheme != "http" && u.Scheme != "https") {
+		invalid("public_url: %q is not an http(s) url", conf.PublicURL)
+	}
+
+	if (len(conf.TLS.Cert) > 0) != (len(conf.TLS.Key) > 0) {
+		invalid("tls: cert and key must be set together")
+	}
+	for _, file := range []string{conf.TLS.Cert, conf.TLS.Key} {
+		if len(file) == 0 {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			invalid("tls: %v", err)
+		}
+	}
+
+	if conf.SyncInterval <= 0 {
+		invalid("sync_interval: must be positive, got %s", conf.SyncInterval)
+	}
+
+	switch conf.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		invalid("log_level: %q is not one of debug, info, warn, error",
+			conf.LogLevel)
+	}
+
+	if len(conf.HTTP.ProxyURL) > 0 {
+		if u, err := url.Parse(conf.HTTP.ProxyURL); err != nil || len(u.Host) == 0 {
+			invalid("http.proxy_url: %q is not a url", conf.HTTP.ProxyURL)
+		}
+	}
+
+	if conf.Health.MaxSyncAge <= 0 {
+		invalid("health.max_sync_age: must be positive")
+	}
+	if conf.Health.MaxSyncErrors < 0 {
+		invalid("health.max_sync_errors: must not be negative")
+	}
+	if conf.Health.MaxLoginWait < 0 {
+		invalid("health.max_login_wait: must not be negative")
+	}
+
+	switch wechat.ImageFormat(conf.Images.Format) {
+	case "", wechat.ImageJPEG, wechat.ImagePNG, wechat.ImageGIF:
+	default:
+		invalid("images.format: %q is not one of jpeg, png, gif",
+			conf.Images.Format)
+	}
+	if conf.Images.MaxDimension < 0 || conf.Images.MaxBytes < 0 ||
+		conf.Images.MaxPixels < 0 {
+		invalid("images: limits must not be negative")
+	}
+	if conf.Images.Quality < 0 || conf.Images.Quality > 100 {
+		invalid("images.quality: must be between 1 and 100")
+	}
+
+	if conf.SendInterval < 0 {
+		invalid("send_interval: must not be negative")
+	}
+
+	for tag, recipients := range conf.Tags {
+		for i, recipient := range recipients {
+			if err := recipient.validate(); err != nil {
+				invalid("tags.%s[%d]: %v", tag, i, err)
+			}
+		}
+	}
+
+	ids := make(map[string]bool)
+	files := make(map[string]string)
+	for i, account := range conf.Accounts {
+		if !reAccountID.MatchString(account.ID) {
+			invalid("accounts[%d].id: %q must be letters, digits, _ or -",
+				i, account.ID)
+		}
+		if ids[account.ID] {
+			invalid("accounts[%d].id: duplicate id %q", i, account.ID)
+		}
+		ids[account.ID] = true
+	}
+
+	for _, account := range conf.accounts() {
+		if len(account.ScheduleFile) == 0 {
+			invalid("accounts.%s.schedule_file: must not be empty", account.ID)
+		}
+		for _, file := range []struct{ name, path string }{
+			{"session_file", account.SessionFile},
+			{"outbox_file", account.OutboxFile},
+			{"history_file", account.HistoryFile},
+			{"schedule_file", account.ScheduleFile},
+		} {
+			if len(file.path) == 0 {
+				continue
+			}
+			if other, ok := files[file.path]; ok {
+				invalid("accounts.%s.%s: %q is also used by %s",
+					account.ID, file.name, file.path, other)
+			}
+			files[file.path] = account.ID
+			if dir := filepath.Dir(file.path); dir != "." {
+				if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+					invalid("accounts.%s.%s: directory %q does not exist",
+						account.ID, file.name, dir)
+				}
+			}
+		}
+	}
+
+	for _, hook := range conf.Webhooks.URLs {
+		if u, err := url.Parse(hook); err != nil ||
+			(u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			invalid("webhooks.urls: %q is not an http(s) url", hook)
+		}
+	}
+	if conf.Webhooks.Retries < 0 {
+		invalid("webhooks.retries: must not be negative")
+	}
+
+	if hook := conf.Notify.WebhookURL; len(hook) > 0 {
+		if u, err := url.Parse(hook); err != nil ||
+			(u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			invalid("notify.webhook_url: %q is not an http(s) url", hook)
+		}
+	}
+	if len(conf.Notify.File) > 0 {
+		if dir := filepath.Dir(conf.Notify.File); dir != "." {
+			if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+				invalid("notify.file: directory %q does not exist", dir)
+			}
+		}
+	}
+	if smtp := conf.Notify.SMTP; len(smtp.Addr) > 0 {
+		if _, _, err := net.SplitHostPort(smtp.Addr); err != nil {
+			invalid("notify.smtp.addr: %q is not a host:port address", smtp.Addr)
+		}
+		if len(smtp.From) == 0 || len(smtp.To) == 0 {
+			invalid("notify.smtp: from and to are required")
+		}
+	}
+
+	if err := validateTokens(conf.Tokens); err != nil {
+		invalid("tokens: %v", err)
+	}
+	if len(conf.Tokens) == 0 && !conf.InsecureNoAuth {
+		invalid("tokens: none configured, set insecure_no_auth to serve the api without authentication")
+	}
+	known := make(map[string]bool)
+	for _, account := range conf.accounts() {
+		known[account.ID] = true
+	}
+	for _, token := range conf.Tokens {
+		for _, id := range token.Accounts {
+			if !known[id] {
+				invalid("tokens: token %q: unknown account %q", token.Name, id)
+			}
+		}
+	}
+
+	if _, err := compileRules(conf.AutoReply.Rules); err != nil {
+		invalid("auto_reply.rules: %v", err)
+	}
+	if len(conf.AutoReply.RulesFile) > 0 {
+		if _, err := loadRulesFile(conf.AutoReply.RulesFile); err != nil {
+			invalid("auto_reply.rules_file: %v", err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New("invalid config:\n  " + strings.Join(errs, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfigOverrides(t *testing.T) {
+	const secret = "0123456789abcdef"
+	t.Setenv("WECHAT_OUTBOX_FILE", "env-outbox.jsonl")
+	t.Setenv("WECHAT_HISTORY_FILE", "env-history.jsonl")
+	t.Setenv("WECHAT_PING_REPLY", "pong")
+	t.Setenv("WECHAT_TOKENS", "env:"+secret+":admin")
+
+	conf, err := loadConfig([]string{
+		"-history-file", "flag-history.jsonl",
+		"-demo-target", "alice",
+		"-token", "ci:" + secret + ":send-text+read-events",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"outbox_file", conf.OutboxFile, "env-outbox.jsonl"},
+		{"history_file", conf.HistoryFile, "flag-history.jsonl"},
+		{"demo_target", conf.DemoTarget, "alice"},
+		{"ping_reply", conf.AutoReply.PingReply, "pong"},
+		{"tokens", conf.Tokens, []Token{{Name: "ci", Token: secret,
+			Scopes: []string{ScopeSendText, ScopeReadEvents}}}},
+	}
+	for _, test := range tests {
+		if !reflect.DeepEqual(test.got, test.want) {
+			t.Errorf("%s = %v, want %v", test.name, test.got, test.want)
+		}
+	}
+}
+
+func TestLoadConfigRequiresTokens(t *testing.T) {
+	if _, err := loadConfig(nil); err == nil {
+		t.Error("config without tokens is valid")
+	}
+
+	t.Setenv("WECHAT_INSECURE_NO_AUTH", "true")
+	if _, err := loadConfig(nil); err != nil {
+		t.Errorf("config with insecure_no_auth: %v", err)
+	}
+
+	if _, err := loadConfig([]string{"-token", "ci"}); err == nil {
+		t.Error("malformed -token accepted")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/binarycraft007/wechat"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ContactKindFriend   = "friend"
+	ContactKindGroup    = "group"
+	ContactKindOfficial = "official"
+)
+
+func contactKind(contact wechat.Contact) string {
+	if wechat.IsGroup(contact.UserName) {
+		return ContactKindGroup
+	}
+	if contact.IsOfficial() {
+		return ContactKindOfficial
+	}
+	return ContactKindFriend
+}
+
+func newContactInfo(contact wechat.Contact) ContactInfo {
+	return ContactInfo{
+		UserName:    contact.UserName,
+		NickName:    contact.NickName,
+		RemarkName:  contact.RemarkName,
+		Alias:       contact.Alias,
+		Kind:        contactKind(contact),
+		Sex:         contact.Sex,
+		Signature:   contact.Signature,
+		Province:    contact.Province,
+		City:        contact.City,
+		HeadImgURL:  contact.HeadImgURL,
+		MemberCount: contact.MemberCount,
+		Starred:     contact.StarFriend != 0,
+	}
+}
+
+// matchContact reports whether the names, remark, alias or pinyin of
+// contact contain keyword, ignoring case.
+func matchContact(contact wechat.Contact, keyword string) bool {
+	keyword = strings.ToLower(keyword)
+	for _, field := range []string{
+		contact.NickName,
+		contact.RemarkName,
+		contact.Alias,
+		contact.PYInitial,
+		contact.PYQuanPin,
+		contact.RemarkPYInitial,
+		contact.RemarkPYQuanPin,
+	} {
+		if strings.Contains(strings.ToLower(field), keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+func listContactsHandler(c *gin.Context) {
+	core := accountOf(c).Core
+	kind := c.Query("kind")
+	switch kind {
+	case "", ContactKindFriend, ContactKindGroup, ContactKindOfficial:
+	default:
+		c.IndentedJSON(http.StatusBadRequest, Message{
+			Msg: "unknown kind: " + kind,
+		})
+		return
+	}
+
+	keyword := c.Query("q")
+
+	contacts := []ContactInfo{}
+	for _, contact := range core.Contacts() {
+		if len(kind) > 0 && contactKind(contact) != kind {
+			continue
+		}
+		if len(keyword) > 0 && !matchContact(contact, keyword) {
+			continue
+		}
+		contacts = append(contacts, newContactInfo(contact))
+	}
+
+	sort.Slice(contacts, func(i, j int) bool {
+		if contacts[i].NickName != contacts[j].NickName {
+			return contacts[i].NickName < contacts[j].NickName
+		}
+		return contacts[i].UserName < contacts[j].UserName
+	})
+
+	c.IndentedJSON(http.StatusOK, contacts)
+}
+
+func getContactHandler(c *gin.Context) {
+	core := accountOf(c).Core
+	contact, ok := core.Contact(c.Param("username"))
+	if !ok {
+		c.IndentedJSON(http.StatusNotFound, Message{
+			Msg: "contact not found: " + c.Param("username"),
+		})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, newContactInfo(contact))
+}
+
+func listMembersHandler(c *gin.Context) {
+	core := accountOf(c).Core
+	userName := c.Param("username")
+
+	group, ok := core.Contact(userName)
+	if !ok || !wechat.IsGroup(userName) {
+		c.IndentedJSON(http.StatusNotFound, Message{
+			Msg: "group not found: " + userName,
+		})
+		return
+	}
+
+	if len(group.MemberList) == 0 {
+		err := core.BatchGetContact([]wechat.Contact{{UserName: userName}})
+		if err != nil {
+			c.IndentedJSON(http.StatusBadGateway, Message{
+				Msg: err.Error(),
+			})
+			return
+		}
+		group, _ = core.Contact(userName)
+	}
+
+	members := make([]MemberInfo, len(group.MemberList))
+	for i, member := range group.MemberList {
+		members[i] = MemberInfo{
+			UserName:    member.UserName,
+			NickName:    member.NickName,
+			DisplayName: member.DisplayName,
+		}
+	}
+
+	c.IndentedJSON(http.StatusOK, members)
+}
+
+func meHandler(c *gin.Context) {
+	user := accountOf(c).Core.Status().User
+	c.IndentedJSON(http.StatusOK, UserInfo{
+		Uin:        user.Uin,
+		UserName:   user.UserName,
+		NickName:   user.NickName,
+		HeadImgURL: user.HeadImgURL,
+		Signature:  user.Signature,
+		Sex:        user.Sex,
+	})
+}
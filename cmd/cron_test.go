@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	tests := []string{
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+	}
+
+	for _, expr := range tests {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) succeeded", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2024, time.January, 10, 10, 30, 15, 0, time.UTC)
+
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 1, 10, 10, 31, 0, 0, time.UTC)},
+		{"30 * * * *", time.Date(2024, 1, 10, 11, 30, 0, 0, time.UTC)},
+		{"0 9 * * *", time.Date(2024, 1, 11, 9, 0, 0, 0, time.UTC)},
+		{"59 23 31 12 *", time.Date(2024, 12, 31, 23, 59, 0, 0, time.UTC)},
+		// steps, ranges and lists
+		{"*/15 * * * *", time.Date(2024, 1, 10, 10, 45, 0, 0, time.UTC)},
+		{"10/20 * * * *", time.Date(2024, 1, 10, 10, 50, 0, 0, time.UTC)},
+		{"0 8-18/4 * * *", time.Date(2024, 1, 10, 12, 0, 0, 0, time.UTC)},
+		{"0 6,22 * * *", time.Date(2024, 1, 10, 22, 0, 0, 0, time.UTC)},
+		// day of week, Sunday is 0 and 7
+		{"0 0 * * 1-5", time.Date(2024, 1, 11, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2024, 1, 14, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 1, 14, 0, 0, 0, 0, time.UTC)},
+		// day of month, or-ed with a restricted day of week
+		{"0 0 1 * *", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 5", time.Date(2024, 1, 12, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+
+	for _, test := range tests {
+		spec, err := ParseCron(test.expr)
+		if err != nil {
+			t.Errorf("ParseCron(%q): %v", test.expr, err)
+			continue
+		}
+		if got := spec.Next(from); !got.Equal(test.want) {
+			t.Errorf("%q: Next = %v, want %v", test.expr, got, test.want)
+		}
+	}
+}
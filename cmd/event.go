@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/binarycraft007/wechat"
+)
+
+const (
+	EventMessageRecv = "message"
+	EventContactMod  = "contact_mod"
+	EventContactDel  = "contact_del"
+	EventLoginState  = "login_state"
+	EventLogout      = "logout"
+)
+
+func (account *Account) newMessageEvent(message wechat.Message) Event {
+	core := account.Core
+	record := core.NewHistoryRecord(message)
+
+	eventMsg := EventMessage{
+		MsgID:          message.MsgID,
+		MsgType:        message.MsgType,
+		FromUserName:   message.FromUserName,
+		FromName:       core.DisplayName(message.FromUserName),
+		ToUserName:     message.ToUserName,
+		ToName:         core.DisplayName(message.ToUserName),
+		SenderUserName: record.SenderUserName,
+		SenderName:     record.SenderName,
+		Text:           record.Text,
+		FileName:       message.FileName,
+		CreateTime:     message.CreateTime,
+		Outgoing:       record.Outgoing,
+	}
+
+	if wechat.IsGroup(record.ChatUserName) {
+		eventMsg.GroupUserName = record.ChatUserName
+		eventMsg.GroupName = record.ChatName
+	}
+
+	switch wechat.MessageType(message.MsgType) {
+	case wechat.Image, wechat.Emoticon, wechat.Voice,
+		wechat.Video, wechat.MicroVideo:
+		eventMsg.MediaURL = fmt.Sprintf("%s/accounts/%s/media/%s?type=%d",
+			config.PublicURL, account.ID, message.MsgID, message.MsgType)
+	}
+
+	return Event{
+		Account: account.ID,
+		Type:    EventMessageRecv,
+		Time:    time.Now().Unix(),
+		Message: &eventMsg,
+	}
+}
+
+func (account *Account) newContactEvent(eventType string, contact wechat.Contact) Event {
+	return Event{
+		Account: account.ID,
+		Type:    eventType,
+		Time:    time.Now().Unix(),
+		Contact: &EventContact{
+			UserName:   contact.UserName,
+			NickName:   contact.NickName,
+			RemarkName: contact.RemarkName,
+		},
+	}
+}
+
+func (account *Account) onContactSync(data *wechat.SyncResponse) error {
+	for _, contact := range data.ModContactList {
+		account.publishEvent(account.newContactEvent(EventContactMod, contact))
+	}
+	for _, contact := range data.DelContactList {
+		account.publishEvent(account.newContactEvent(EventContactDel, contact))
+	}
+	return nil
+}
+
+func (account *Account) newLoginStateEvent(state string) Event {
+	core := account.Core
+	event := Event{
+		Account: account.ID,
+		Type:    EventLoginState,
+		Time:    time.Now().Unix(),
+		State:   state,
+	}
+
+	if len(core.User.UserName) > 0 {
+		event.Contact = &EventContact{
+			UserName: core.User.UserName,
+			NickName: core.User.NickName,
+		}
+	}
+
+	return event
+}
+
+func (account *Account) newLogoutEvent() Event {
+	return Event{
+		Account: account.ID,
+		Type:    EventLogout,
+		Time:    time.Now().Unix(),
+		Contact: &EventContact{
+			UserName: account.Core.User.UserName,
+			NickName: account.Core.User.NickName,
+		},
+	}
+}
+
+// publishEvent hands event to every consumer of the sync events of
+// account.
+func (account *Account) publishEvent(event Event) {
+	event = account.Hub.Publish(event)
+	webhooks.Deliver(event)
+}
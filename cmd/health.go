@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type HealthStatus struct {
+	Account           string     `json:"account"`
+	Healthy           bool       `json:"healthy"`
+	Ready             bool       `json:"ready"`
+	Reason            string     `json:"reason,omitempty"`
+	State             string     `json:"state"`
+	LastSyncTime      *time.Time `json:"last_sync_time,omitempty"`
+	ConsecutiveErrors int        `json:"consecutive_errors"`
+	LastError         string     `json:"last_error,omitempty"`
+}
+
+// HealthReport sums up the accounts, the process is only healthy or
+// ready when all of them are.
+type HealthReport struct {
+	Healthy  bool           `json:"healthy"`
+	Ready    bool           `json:"ready"`
+	Accounts []HealthStatus `json:"accounts"`
+}
+
+// healthStatus judges the Core status of account. An account waiting for
+// a QR code scan is healthy but not ready until it waited longer than
+// MaxLoginWait, one whose session stopped syncing is neither.
+func healthStatus(account *Account) HealthStatus {
+	status := account.Core.Status()
+	health := HealthStatus{
+		Account:           account.ID,
+		Healthy:           true,
+		State:             loginStates[status.LoginState],
+		ConsecutiveErrors: status.ConsecutiveErrors,
+		LastError:         status.LastError,
+	}
+	if !status.LastSyncTime.IsZero() {
+		health.LastSyncTime = &status.LastSyncTime
+	}
+
+	if !status.LoggedIn {
+		health.Reason = "not logged in"
+		if wait := config.Health.MaxLoginWait; wait > 0 &&
+			time.Since(status.LoginSince) > wait {
+			health.Healthy = false
+			health.Reason = "not logged in since " +
+				status.LoginSince.Format(time.RFC3339)
+		}
+		return health
+	}
+
+	lastSync := status.LastSyncTime
+	if lastSync.Before(status.InitTime) {
+		lastSync = status.InitTime
+	}
+
+	switch {
+	case status.ConsecutiveErrors > config.Health.MaxSyncErrors:
+		health.Healthy = false
+		health.Reason = "too many consecutive sync errors"
+	case time.Since(lastSync) > config.Health.MaxSyncAge:
+		health.Healthy = false
+		health.Reason = "no successful sync check since " +
+			lastSync.Format(time.RFC3339)
+	default:
+		health.Ready = true
+	}
+
+	return health
+}
+
+func healthReport() HealthReport {
+	report := HealthReport{Healthy: true, Ready: true}
+	for _, account := range accounts.All() {
+		health := healthStatus(account)
+		report.Healthy = report.Healthy && health.Healthy
+		report.Ready = report.Ready && health.Ready
+		report.Accounts = append(report.Accounts, health)
+	}
+	return report
+}
+
+func statusCode(ok bool) int {
+	if ok {
+		return http.StatusOK
+	}
+	return http.StatusServiceUnavailable
+}
+
+func healthzHandler(c *gin.Context) {
+	report := healthReport()
+	c.JSON(statusCode(report.Healthy), report)
+}
+
+func readyzHandler(c *gin.Context) {
+	report := healthReport()
+	c.JSON(statusCode(report.Ready), report)
+}
+
+func accountHealthzHandler(c *gin.Context) {
+	health := healthStatus(accountOf(c))
+	c.JSON(statusCode(health.Healthy), health)
+}
+
+func accountReadyzHandler(c *gin.Context) {
+	health := healthStatus(accountOf(c))
+	c.JSON(statusCode(health.Ready), health)
+}
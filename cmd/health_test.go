@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/binarycraft007/wechat"
+)
+
+func TestHealthStatusLoginWait(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	core, err := wechat.New(wechat.CoreOption{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := &Account{ID: "main", Core: core}
+	time.Sleep(time.Millisecond)
+
+	tests := []struct {
+		wait    time.Duration
+		healthy bool
+	}{
+		{0, true},
+		{time.Hour, true},
+		{time.Nanosecond, false},
+	}
+
+	for _, test := range tests {
+		config = defaultConfig()
+		config.Health.MaxLoginWait = test.wait
+
+		health := healthStatus(account)
+		if health.Healthy != test.healthy || health.Ready {
+			t.Errorf("wait %v: healthy %v ready %v, want healthy %v and not ready",
+				test.wait, health.Healthy, health.Ready, test.healthy)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import "github.com/binarycraft007/wechat"
+
+// logger is replaced in main once the level is known.
+var logger = newLogger("info")
+
+// argsLogger adds args to every record of the Logger it wraps.
+type argsLogger struct {
+	wechat.Logger
+	args []any
+}
+
+func withArgs(logger wechat.Logger, args ...any) wechat.Logger {
+	return argsLogger{logger, args}
+}
+
+func (l argsLogger) with(args []any) []any {
+	return append(append([]any{}, l.args...), args...)
+}
+
+func (l argsLogger) Debug(msg string, args ...any) { l.Logger.Debug(msg, l.with(args)...) }
+
+func (l argsLogger) Info(msg string, args ...any) { l.Logger.Info(msg, l.with(args)...) }
+
+func (l argsLogger) Warn(msg string, args ...any) { l.Logger.Warn(msg, l.with(args)...) }
+
+func (l argsLogger) Error(msg string, args ...any) { l.Logger.Error(msg, l.with(args)...) }
@@ -0,0 +1,44 @@
+//go:build !go1.21
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/binarycraft007/wechat"
+)
+
+var logLevels = map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3}
+
+// stdLogger writes records at or above its level to the standard logger
+// where log/slog is missing.
+type stdLogger struct {
+	level int
+}
+
+func newLogger(level string) wechat.Logger {
+	return stdLogger{logLevels[level]} // validated with the config
+}
+
+func (l stdLogger) Debug(msg string, args ...any) { l.log(0, "DEBUG", msg, args) }
+
+func (l stdLogger) Info(msg string, args ...any) { l.log(1, "INFO", msg, args) }
+
+func (l stdLogger) Warn(msg string, args ...any) { l.log(2, "WARN", msg, args) }
+
+func (l stdLogger) Error(msg string, args ...any) { l.log(3, "ERROR", msg, args) }
+
+func (l stdLogger) log(level int, name string, msg string, args []any) {
+	if level < l.level {
+		return
+	}
+
+	var line strings.Builder
+	line.WriteString(name + " " + msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&line, " %v=%v", args[i], args[i+1])
+	}
+	log.Print(line.String())
+}
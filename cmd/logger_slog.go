@@ -0,0 +1,17 @@
+//go:build go1.21
+
+package main
+
+import (
+	"log/slog"
+	"os"
+
+	"github.com/binarycraft007/wechat"
+)
+
+func newLogger(level string) wechat.Logger {
+	var leveler slog.Level
+	leveler.UnmarshalText([]byte(level)) // validated with the config
+	return slog.New(slog.NewTextHandler(os.Stderr,
+		&slog.HandlerOptions{Level: leveler}))
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/binarycraft007/wechat"
+	"github.com/gin-gonic/gin"
+	"github.com/skip2/go-qrcode"
+)
+
+var loginStates = map[wechat.LoginState]string{
+	wechat.LoginIdle:      "idle",
+	wechat.LoginWaiting:   "waiting",
+	wechat.LoginScanned:   "scanned",
+	wechat.LoginConfirmed: "confirmed",
+	wechat.LoginExpired:   "expired",
+	wechat.LoggedIn:       "logged_in",
+	wechat.LoggedOut:      "logged_out",
+}
+
+var errSessionEnded = errors.New("session ended")
+
+func (account *Account) onLoginState(state wechat.LoginState) {
+	account.publishEvent(account.newLoginStateEvent(loginStates[state]))
+}
+
+// runSessions logs in and syncs until ctx is done. A session the server
+// ended is resumed when possible, otherwise an operator is notified and a
+// new qrcode waits to be scanned.
+func (account *Account) runSessions(ctx context.Context) {
+	defer close(account.stopped)
+
+	core := account.Core
+	resume := true  // the session of the last run may still be valid
+	var ended error // why the previous session ended, nil before the first
+	for ctx.Err() == nil {
+		err := account.login(ctx, resume, ended)
+		resume, ended = false, nil
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Error("login failed", "account", account.ID, "err", err)
+				sleepContext(ctx, 5*time.Second)
+			}
+			continue
+		}
+
+		sessionCtx, cancel := context.WithCancel(ctx)
+		account.sessionMu.Lock()
+		account.sessionCancel = cancel
+		account.sessionMu.Unlock()
+
+		if err := periodicSync(PeriodicSyncOption{
+			Context: sessionCtx,
+			Core:    core,
+			Period:  config.SyncInterval,
+		}); err != nil {
+			logger.Warn("sync stopped", "account", account.ID, "err", err)
+			// Not logged out from the api, try to get the session back
+			resume = err == wechat.ErrAlreadyLoggedOut
+			ended = err
+		} else {
+			ended = errSessionEnded
+		}
+
+		account.sessionMu.Lock()
+		account.sessionCancel = nil
+		logoutResult := account.logoutResult
+		account.logoutResult = nil
+		account.sessionMu.Unlock()
+		cancel()
+
+		// Logging out here keeps it from racing with SyncPolling
+		if logoutResult != nil {
+			logoutResult <- core.Logout()
+		}
+
+		account.publishEvent(account.newLogoutEvent())
+		logger.Info("logged out", "account", account.ID,
+			"user", core.User.NickName)
+	}
+}
+
+// login resumes the persisted session when resume is set and falls back
+// to a qrcode. An operator is notified about the qrcode when a session
+// existed before, ended says why it is gone.
+func (account *Account) login(ctx context.Context, resume bool, ended error) error {
+	core := account.Core
+
+	if resume {
+		err := core.ResumeSession(ctx)
+		if err == nil {
+			logger.Info("session resumed", "account", account.ID,
+				"user", core.User.NickName)
+			return account.startSession()
+		}
+		if err != wechat.ErrNoSession {
+			logger.Warn("resume session failed", "account", account.ID,
+				"err", err)
+			ended = err
+		}
+	}
+
+	if ended != nil {
+		account.notifyLogin(ended)
+	}
+
+	for {
+		if err := core.GetUUID(); err != nil {
+			return err
+		}
+
+		fmt.Println(core.QrCode)    // print qrcode
+		fmt.Println(core.QrCodeUrl) // qrcode url
+
+		err := waitForScan(ctx, core)
+		if err == wechat.ErrQrCodeExpired {
+			// Only fetch a new qrcode when somebody is going to scan it
+			select {
+			case <-account.qrRefresh:
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if err != nil {
+			return err
+		}
+		break
+	}
+
+	if err := core.Login(); err != nil {
+		return err
+	}
+
+	if err := core.Init(); err != nil {
+		return err
+	}
+
+	return account.startSession()
+}
+
+// startSession completes a login, messages left in the outbox are sent
+// before syncing starts.
+func (account *Account) startSession() error {
+	core := account.Core
+	if err := core.StatusNotify(); err != nil {
+		return err
+	}
+
+	if err := core.GetContact(); err != nil {
+		return err
+	}
+
+	if err := core.ReplayOutbox(); err != nil {
+		logger.Error("replay outbox failed", "account", account.ID, "err", err)
+	}
+
+	return nil
+}
+
+// notifyLogin asks an operator to scan the qrcode served by the api, it
+// outlives the qrcodes themselves which expire after a few minutes.
+func (account *Account) notifyLogin(reason error) {
+	nickName := account.Core.User.NickName
+	loginURL := config.PublicURL + "/accounts/" + account.ID + "/login/qr"
+	name := account.ID
+	if len(nickName) > 0 {
+		name += " (" + nickName + ")"
+	}
+	notifier.Notify(Notification{
+		Account:  account.ID,
+		NickName: nickName,
+		Reason:   reason.Error(),
+		LoginURL: loginURL,
+		Time:     time.Now().Unix(),
+		Text: fmt.Sprintf("WeChat account %s lost its session: %v. "+
+			"Scan the qrcode at %s to log in again.", name, reason, loginURL),
+	})
+}
+
+func waitForScan(ctx context.Context, core *wechat.Core) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Returns ErrLoginTimeout every ~25s while nobody scans
+		if err := core.PreLogin(); err != wechat.ErrLoginTimeout {
+			return err
+		}
+	}
+}
+
+func sleepContext(ctx context.Context, duration time.Duration) {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+func loginQrHandler(c *gin.Context) {
+	account := accountOf(c)
+	core := account.Core
+	if core.LoginState() == wechat.LoginExpired {
+		select {
+		case account.qrRefresh <- struct{}{}:
+		default:
+		}
+
+		for i := 0; i < 100 && core.LoginState() == wechat.LoginExpired; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	status := core.Status()
+	switch status.LoginState {
+	case wechat.LoginWaiting, wechat.LoginScanned:
+	default:
+		c.IndentedJSON(http.StatusConflict, Message{
+			Msg: "no qrcode to scan, login state: " + loginStates[status.LoginState],
+		})
+		return
+	}
+	if len(status.QrCodeContent) == 0 {
+		c.IndentedJSON(http.StatusConflict, Message{
+			Msg: "no qrcode to scan yet",
+		})
+		return
+	}
+
+	png, err := qrcode.Encode(status.QrCodeContent, qrcode.Medium, 256)
+	if err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, Message{
+			Msg: err.Error(),
+		})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "image/png", png)
+}
+
+func loginStatusHandler(c *gin.Context) {
+	core := accountOf(c).Core
+	snapshot := core.Status()
+	status := LoginStatus{State: loginStates[snapshot.LoginState]}
+
+	switch snapshot.LoginState {
+	case wechat.LoginWaiting:
+		status.QrCodeUrl = snapshot.QrCodeUrl
+	case wechat.LoginScanned, wechat.LoginConfirmed:
+		status.Avatar = snapshot.Avatar
+	case wechat.LoggedIn:
+		status.Avatar = snapshot.Avatar
+		status.NickName = snapshot.User.NickName
+	}
+
+	c.IndentedJSON(http.StatusOK, status)
+}
+
+func logoutHandler(c *gin.Context) {
+	account := accountOf(c)
+
+	// The session loop logs out once syncing stopped
+	result := make(chan error, 1)
+	account.sessionMu.Lock()
+	cancel := account.sessionCancel
+	if cancel != nil && account.logoutResult == nil &&
+		account.Core.LoginState() == wechat.LoggedIn {
+		account.logoutResult = result
+	} else {
+		cancel = nil
+	}
+	account.sessionMu.Unlock()
+
+	if cancel == nil {
+		c.IndentedJSON(http.StatusConflict, Message{
+			Msg: "not logged in",
+		})
+		return
+	}
+	cancel()
+
+	var err error
+	select {
+	case err = <-result:
+	case <-c.Request.Context().Done():
+		return
+	}
+
+	if err != nil {
+		c.IndentedJSON(http.StatusBadGateway, Message{Msg: err.Error()})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, Message{Msg: "success"})
+}
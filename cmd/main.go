@@ -2,54 +2,54 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
-	"github.com/binarycraft007/wechat"
 	"github.com/gin-gonic/gin"
 )
 
-var core *wechat.Core
-
 func main() {
 	var err error
 
-	if core, err = wechat.New(wechat.CoreOption{
-		SyncMsgFunc:     onMsgRecv,
-		SyncContactFunc: nil,
-	}); err != nil {
+	if config, err = loadConfig(os.Args[1:]); err != nil {
 		log.Fatal(err)
 	}
 
-	if err = core.GetUUID(); err != nil {
-		log.Fatal(err)
+	if config.LogLevel != "debug" {
+		gin.SetMode(gin.ReleaseMode)
 	}
 
-	fmt.Println(core.QrCode)    // print qrcode
-	fmt.Println(core.QrCodeUrl) // qrcode url
+	logger = newLogger(config.LogLevel)
 
-	if err = core.PreLogin(); err != nil {
-		log.Fatal(err)
+	tokens = config.Tokens
+	insecureNoAuth = config.InsecureNoAuth
+	if len(tokens) == 0 && insecureNoAuth {
+		logger.Warn("no api tokens configured, authentication disabled")
 	}
 
-	if err = core.Login(); err != nil {
-		log.Fatal(err)
-	}
+	webhooks = newWebhooks(WebhookOption{
+		URLs:    config.Webhooks.URLs,
+		Secret:  config.Webhooks.Secret,
+		Retries: config.Webhooks.Retries,
+		Reply:   config.Webhooks.Reply,
+	})
 
-	if err = core.Init(); err != nil {
-		log.Fatal(err)
-	}
+	notifier = newNotifier(config.Notify)
 
-	if err = core.StatusNotify(); err != nil {
+	if rules, err = newRuleEngine(config.AutoReply.Rules,
+		config.AutoReply.RulesFile); err != nil {
 		log.Fatal(err)
 	}
+	go rules.watch(2 * time.Second)
 
-	if err = core.GetContact(); err != nil {
+	if accounts, err = newAccountManager(config.accounts()); err != nil {
 		log.Fatal(err)
 	}
+	defer accounts.Close()
 
 	interruptContext, stop := signal.NotifyContext(
 		context.Background(),
@@ -61,32 +61,36 @@ func main() {
 	defer cancel()
 	defer stop()
 
-	go periodicSync(PeriodicSyncOption{ // as a goroutine
-		Cancel: cancel,
-		Period: 20,
-	})
-
 	router := gin.Default()
 	initAllApiHanlders(router) // init all api handlers
 
-	srv := &http.Server{Addr: ":8080", Handler: router}
+	srv := &http.Server{Addr: config.Listen, Handler: router}
 
 	go func() {
-		if err := srv.ListenAndServe(); err != nil &&
-			err != http.ErrServerClosed {
-			log.Println("listen error:", err)
+		var err error
+		if len(config.TLS.Cert) > 0 {
+			err = srv.ListenAndServeTLS(config.TLS.Cert, config.TLS.Key)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error("listen failed", "addr", config.Listen, "err", err)
 			cancel()
 		}
 	}()
 
+	accounts.Run(ctx)
+
 	select {
-	case <-ctx.Done(): // When sync returned 1101
-		if err = core.Logout(); err != nil {
-			log.Println("logout error:", err.Error())
-		}
-		if err := srv.Shutdown(ctx); err != nil {
-			log.Println("shutdown error:", err.Error())
+	case <-ctx.Done(): // When interrupted
+		accounts.Logout()
+
+		shutdownCtx, shutdownCancel := context.WithTimeout(
+			context.Background(), 5*time.Second)
+		defer shutdownCancel()
+
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logger.Error("shutdown failed", "err", err)
 		}
-		log.Println("logged out:", core.User.NickName)
 	}
 }
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/binarycraft007/wechat"
+	"github.com/gin-gonic/gin"
+)
+
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(value float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(durationBuckets))
+	}
+	for i, bound := range durationBuckets {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// Metrics implements wechat.Metrics and renders what it collected in
+// the Prometheus text format.
+type Metrics struct {
+	mu             sync.Mutex
+	syncChecks     map[string]float64 // by selector
+	syncErrors     float64
+	syncDuration   histogram
+	received       map[string]float64 // by msg_type
+	sent           map[string]float64 // by msg_type, outcome and ret
+	uploads        map[string]float64 // by outcome
+	uploadBytes    float64
+	uploadDuration histogram
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		syncChecks: make(map[string]float64),
+		received:   make(map[string]float64),
+		sent:       make(map[string]float64),
+		uploads:    make(map[string]float64),
+	}
+}
+
+func (m *Metrics) ObserveSyncCheck(duration time.Duration,
+	selector wechat.SyncType, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.syncDuration.observe(duration.Seconds())
+	if err != nil {
+		m.syncErrors++
+		return
+	}
+	m.syncChecks[labels("selector", strconv.Itoa(selector))]++
+}
+
+func (m *Metrics) ObserveMessageReceived(msgType wechat.MessageType) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.received[labels("msg_type", strconv.Itoa(int(msgType)))]++
+}
+
+func (m *Metrics) ObserveSend(msgType wechat.MessageType, ret int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sent[labels(
+		"msg_type", strconv.Itoa(int(msgType)),
+		"outcome", outcome(err),
+		"ret", strconv.Itoa(ret),
+	)]++
+}
+
+func (m *Metrics) ObserveUpload(size int, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.uploads[labels("outcome", outcome(err))]++
+	if err == nil {
+		m.uploadBytes += float64(size)
+	}
+	m.uploadDuration.observe(duration.Seconds())
+}
+
+// outcome tells requests the server refused apart from those that never
+// got an answer.
+func outcome(err error) string {
+	var retErr *wechat.RetError
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.As(err, &retErr):
+		return "rejected"
+	}
+	return "error"
+}
+
+func labels(pairs ...string) string {
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", pairs[i], pairs[i+1]))
+	}
+	return strings.Join(parts, ",")
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeSample(w io.Writer, name, labels string, value float64) {
+	if len(labels) > 0 {
+		name += "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s %s\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// withLabel prepends label to the rendered labels of a sample.
+func withLabel(label, labels string) string {
+	if len(labels) == 0 {
+		return label
+	}
+	return label + "," + labels
+}
+
+func writeCounters(w io.Writer, name, label string, values map[string]float64) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		writeSample(w, name, withLabel(label, key), values[key])
+	}
+}
+
+func writeHistogram(w io.Writer, name, label string, h *histogram) {
+	var cumulative uint64
+	for i, bound := range durationBuckets {
+		if h.counts != nil {
+			cumulative += h.counts[i]
+		}
+		writeSample(w, name+"_bucket", withLabel(label,
+			labels("le", strconv.FormatFloat(bound, 'g', -1, 64))),
+			float64(cumulative))
+	}
+	writeSample(w, name+"_bucket", withLabel(label, `le="+Inf"`),
+		float64(h.count))
+	writeSample(w, name+"_sum", label, h.sum)
+	writeSample(w, name+"_count", label, float64(h.count))
+}
+
+type metricFamily struct {
+	name, kind, help string
+	write            func(w io.Writer, name, label string, account *Account)
+}
+
+var metricFamilies = []metricFamily{
+	{"wechat_sync_check_duration_seconds", "histogram",
+		"Latency of synccheck requests.",
+		func(w io.Writer, name, label string, account *Account) {
+			writeHistogram(w, name, label, &account.Metrics.syncDuration)
+		}},
+	{"wechat_sync_checks_total", "counter",
+		"Successful synccheck requests by returned selector.",
+		func(w io.Writer, name, label string, account *Account) {
+			writeCounters(w, name, label, account.Metrics.syncChecks)
+		}},
+	{"wechat_sync_check_errors_total", "counter",
+		"Failed synccheck requests.",
+		func(w io.Writer, name, label string, account *Account) {
+			writeSample(w, name, label, account.Metrics.syncErrors)
+		}},
+	{"wechat_messages_received_total", "counter",
+		"Messages received by MsgType.",
+		func(w io.Writer, name, label string, account *Account) {
+			writeCounters(w, name, label, account.Metrics.received)
+		}},
+	{"wechat_messages_sent_total", "counter",
+		"Messages sent by MsgType, outcome and Ret code.",
+		func(w io.Writer, name, label string, account *Account) {
+			writeCounters(w, name, label, account.Metrics.sent)
+		}},
+	{"wechat_uploads_total", "counter",
+		"Media uploads by outcome.",
+		func(w io.Writer, name, label string, account *Account) {
+			writeCounters(w, name, label, account.Metrics.uploads)
+		}},
+	{"wechat_upload_bytes_total", "counter",
+		"Bytes of successfully uploaded media.",
+		func(w io.Writer, name, label string, account *Account) {
+			writeSample(w, name, label, account.Metrics.uploadBytes)
+		}},
+	{"wechat_upload_duration_seconds", "histogram",
+		"Duration of media uploads.",
+		func(w io.Writer, name, label string, account *Account) {
+			writeHistogram(w, name, label, &account.Metrics.uploadDuration)
+		}},
+	{"wechat_logged_in", "gauge",
+		"Whether the account is logged in.",
+		func(w io.Writer, name, label string, account *Account) {
+			loggedIn := 0.0
+			if account.Core.LoginState() == wechat.LoggedIn {
+				loggedIn = 1
+			}
+			writeSample(w, name, label, loggedIn)
+		}},
+	{"wechat_session_age_seconds", "gauge",
+		"Time since the current session was initialized.",
+		func(w io.Writer, name, label string, account *Account) {
+			age := 0.0
+			if status := account.Core.Status(); status.LoggedIn {
+				age = time.Since(status.InitTime).Seconds()
+			}
+			writeSample(w, name, label, age)
+		}},
+	{"wechat_contacts", "gauge",
+		"Known contacts.",
+		func(w io.Writer, name, label string, account *Account) {
+			writeSample(w, name, label, float64(account.Core.ContactCount()))
+		}},
+}
+
+// writeMetrics renders every family once, with a sample set per account.
+func writeMetrics(w io.Writer, all []*Account) {
+	for _, family := range metricFamilies {
+		writeHeader(w, family.name, family.kind, family.help)
+		for _, account := range all {
+			account.Metrics.mu.Lock()
+			family.write(w, family.name, labels("account", account.ID), account)
+			account.Metrics.mu.Unlock()
+		}
+	}
+}
+
+func metricsHandler(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(c.Writer, accounts.All())
+}
@@ -1,10 +1,127 @@
 package main
 
 type SendMessageRequest struct {
-	TextMsg  string `json:"TextMsg"`
-	NickName string `json:"NickName"`
+	TextMsg  string      `json:"TextMsg"`
+	NickName string      `json:"NickName"` // first fuzzy match, legacy
+	To       []Recipient `json:"To"`
+	Tag      string      `json:"Tag"`
+}
+
+// Recipient selects contacts by exactly one of its fields.
+type Recipient struct {
+	UserName   string `json:"UserName,omitempty" yaml:"user_name"`
+	NickName   string `json:"NickName,omitempty" yaml:"nick_name"`
+	RemarkName string `json:"RemarkName,omitempty" yaml:"remark_name"`
+	Alias      string `json:"Alias,omitempty" yaml:"alias"`
+	Group      string `json:"Group,omitempty" yaml:"group"`
+}
+
+type SendResult struct {
+	Recipient string `json:"recipient"`
+	UserName  string `json:"user_name,omitempty"`
+	Name      string `json:"name,omitempty"`
+	MsgID     string `json:"msg_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+	Queued    bool   `json:"queued,omitempty"` // sent after the next login
+}
+
+type SendResponse struct {
+	Msg     string       `json:"message"`
+	Results []SendResult `json:"results"`
 }
 
 type Message struct {
 	Msg string `json:"message"`
 }
+
+type Event struct {
+	ID      uint64        `json:"id"` // per account
+	Account string        `json:"account"`
+	Type    string        `json:"type"`
+	Time    int64         `json:"time"`
+	Message *EventMessage `json:"message,omitempty"`
+	Contact *EventContact `json:"contact,omitempty"`
+	State   string        `json:"state,omitempty"`
+}
+
+type EventMessage struct {
+	MsgID          string `json:"msg_id"`
+	MsgType        int    `json:"msg_type"`
+	FromUserName   string `json:"from_user_name"`
+	FromName       string `json:"from_name"`
+	ToUserName     string `json:"to_user_name"`
+	ToName         string `json:"to_name"`
+	GroupUserName  string `json:"group_user_name,omitempty"`
+	GroupName      string `json:"group_name,omitempty"`
+	SenderUserName string `json:"sender_user_name"`
+	SenderName     string `json:"sender_name"`
+	Text           string `json:"text"`
+	FileName       string `json:"file_name,omitempty"`
+	MediaURL       string `json:"media_url,omitempty"`
+	CreateTime     int    `json:"create_time"`
+	Outgoing       bool   `json:"outgoing"`
+}
+
+type EventContact struct {
+	UserName   string `json:"user_name"`
+	NickName   string `json:"nick_name"`
+	RemarkName string `json:"remark_name,omitempty"`
+}
+
+type WebhookReply struct {
+	Reply string `json:"reply"`
+}
+
+type ContactInfo struct {
+	UserName    string `json:"user_name"`
+	NickName    string `json:"nick_name"`
+	RemarkName  string `json:"remark_name"`
+	Alias       string `json:"alias"`
+	Kind        string `json:"kind"`
+	Sex         int    `json:"sex"`
+	Signature   string `json:"signature"`
+	Province    string `json:"province"`
+	City        string `json:"city"`
+	HeadImgURL  string `json:"head_img_url"`
+	MemberCount int    `json:"member_count"`
+	Starred     bool   `json:"starred"`
+}
+
+type MemberInfo struct {
+	UserName    string `json:"user_name"`
+	NickName    string `json:"nick_name"`
+	DisplayName string `json:"display_name"`
+}
+
+type UserInfo struct {
+	Uin        int    `json:"uin"`
+	UserName   string `json:"user_name"`
+	NickName   string `json:"nick_name"`
+	HeadImgURL string `json:"head_img_url"`
+	Signature  string `json:"signature"`
+	Sex        int    `json:"sex"`
+}
+
+type AccountInfo struct {
+	ID       string `json:"id"`
+	State    string `json:"state"`
+	NickName string `json:"nick_name,omitempty"`
+}
+
+type LoginStatus struct {
+	State     string `json:"state"`
+	Avatar    string `json:"avatar,omitempty"`
+	QrCodeUrl string `json:"qrcode_url,omitempty"`
+	NickName  string `json:"nick_name,omitempty"`
+}
+
+// Notification asks an operator to scan a new qrcode for an account that
+// lost its session. Text makes it readable by chat incoming webhooks.
+type Notification struct {
+	Account  string `json:"account"`
+	NickName string `json:"nick_name,omitempty"`
+	Reason   string `json:"reason"`
+	LoginURL string `json:"login_url"`
+	Time     int64  `json:"time"`
+	Text     string `json:"text"`
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+type Notifier struct {
+	options NotifyConfig
+	client  *http.Client
+}
+
+var notifier *Notifier
+
+func newNotifier(options NotifyConfig) *Notifier {
+	return &Notifier{
+		options: options,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Notify sends notification on every configured channel in the
+// background, failures are logged.
+func (n *Notifier) Notify(notification Notification) {
+	if n == nil {
+		return
+	}
+
+	go n.deliver(notification)
+}
+
+func (n *Notifier) deliver(notification Notification) {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		logger.Error("notification marshal failed", "err", err)
+		return
+	}
+
+	if len(n.options.WebhookURL) > 0 {
+		if err := n.post(body); err != nil {
+			logger.Error("notification webhook failed",
+				"url", n.options.WebhookURL, "err", err)
+		}
+	}
+
+	if len(n.options.File) > 0 {
+		if err := n.append(body); err != nil {
+			logger.Error("notification file failed",
+				"file", n.options.File, "err", err)
+		}
+	}
+
+	if len(n.options.SMTP.Addr) > 0 {
+		if err := n.mail(notification); err != nil {
+			logger.Error("notification mail failed",
+				"addr", n.options.SMTP.Addr, "err", err)
+		}
+	}
+}
+
+func (n *Notifier) post(body []byte) error {
+	resp, err := n.client.Post(n.options.WebhookURL, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return webhookError{statusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+func (n *Notifier) append(body []byte) error {
+	file, err := os.OpenFile(n.options.File,
+		os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(append(body, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (n *Notifier) mail(notification Notification) error {
+	options := n.options.SMTP
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", options.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(options.To, ", "))
+	fmt.Fprintf(&msg, "Subject: WeChat account %s needs a login\r\n",
+		notification.Account)
+	fmt.Fprintf(&msg, "Date: %s\r\n",
+		time.Unix(notification.Time, 0).Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(notification.Text + "\r\n")
+
+	return smtp.SendMail(options.Addr, nil, options.From, options.To,
+		[]byte(msg.String()))
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/binarycraft007/wechat"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	errRecipientNotFound   = errors.New("recipient not found")
+	errRecipientAmbiguous  = errors.New("recipient is ambiguous")
+	errRecipientNotAllowed = errors.New("recipient not allowed for token")
+	errRecipientInvalid    = errors.New("recipient must set exactly one field")
+)
+
+func (recipient Recipient) String() string {
+	switch {
+	case len(recipient.UserName) > 0:
+		return "user_name:" + recipient.UserName
+	case len(recipient.NickName) > 0:
+		return "nick_name:" + recipient.NickName
+	case len(recipient.RemarkName) > 0:
+		return "remark_name:" + recipient.RemarkName
+	case len(recipient.Alias) > 0:
+		return "alias:" + recipient.Alias
+	case len(recipient.Group) > 0:
+		return "group:" + recipient.Group
+	}
+	return "empty"
+}
+
+func (recipient Recipient) validate() error {
+	count := 0
+	for _, field := range []string{
+		recipient.UserName,
+		recipient.NickName,
+		recipient.RemarkName,
+		recipient.Alias,
+		recipient.Group,
+	} {
+		if len(field) > 0 {
+			count++
+		}
+	}
+	if count != 1 {
+		return errRecipientInvalid
+	}
+	return nil
+}
+
+func (recipient Recipient) match(contact wechat.Contact) bool {
+	switch {
+	case len(recipient.UserName) > 0:
+		return contact.UserName == recipient.UserName
+	case len(recipient.NickName) > 0:
+		return contact.NickName == recipient.NickName
+	case len(recipient.RemarkName) > 0:
+		return contact.RemarkName == recipient.RemarkName
+	case len(recipient.Alias) > 0:
+		return contact.Alias == recipient.Alias
+	case len(recipient.Group) > 0:
+		return wechat.IsGroup(contact.UserName) &&
+			(contact.NickName == recipient.Group ||
+				contact.RemarkName == recipient.Group)
+	}
+	return false
+}
+
+func (recipient Recipient) resolve(core *wechat.Core) (string, error) {
+	if err := recipient.validate(); err != nil {
+		return "", err
+	}
+
+	if len(recipient.UserName) > 0 {
+		// filehelper and friends are not always in the contact list
+		return recipient.UserName, nil
+	}
+
+	var found []string
+	for _, contact := range core.Contacts() {
+		if recipient.match(contact) {
+			found = append(found, contact.UserName)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", errRecipientNotFound
+	case 1:
+		return found[0], nil
+	}
+	return "", errRecipientAmbiguous
+}
+
+// selectRecipients expands the selectors, the tag and the legacy fuzzy
+// nickname of a send request into one result per distinct recipient among
+// the contacts of core.
+func selectRecipients(core *wechat.Core, req SendMessageRequest, token *Token) ([]SendResult, error) {
+	selectors := req.To
+	if len(req.Tag) > 0 {
+		tagged, ok := config.Tags[req.Tag]
+		if !ok {
+			return nil, fmt.Errorf("unknown tag: %s", req.Tag)
+		}
+		selectors = append(selectors, tagged...)
+	}
+
+	var results []SendResult
+	seen := make(map[string]bool)
+
+	if len(req.NickName) > 0 {
+		result := SendResult{Recipient: "nick_name~" + req.NickName}
+		for _, contact := range core.Contacts() {
+			if strings.Contains(contact.NickName, req.NickName) &&
+				token.allows(contact) {
+				result.UserName = contact.UserName
+				break
+			}
+		}
+		if len(result.UserName) == 0 {
+			result.Error = errRecipientNotFound.Error()
+		}
+		seen[result.UserName] = len(result.UserName) > 0
+		results = append(results, result)
+	}
+
+	for _, selector := range selectors {
+		result := SendResult{Recipient: selector.String()}
+
+		userName, err := selector.resolve(core)
+		if err == nil && !token.allows(contactOf(core, userName)) {
+			err = errRecipientNotAllowed
+		}
+
+		if err != nil {
+			result.Error = err.Error()
+		} else if seen[userName] {
+			continue
+		} else {
+			seen[userName] = true
+			result.UserName = userName
+		}
+		results = append(results, result)
+	}
+
+	if len(results) == 0 {
+		return nil, errors.New("no recipient given")
+	}
+
+	for i := range results {
+		if len(results[i].UserName) > 0 {
+			results[i].Name = core.DisplayName(results[i].UserName)
+		}
+	}
+
+	return results, nil
+}
+
+func contactOf(core *wechat.Core, userName string) wechat.Contact {
+	if contact, ok := core.Contact(userName); ok {
+		return contact
+	}
+	return wechat.Contact{UserName: userName}
+}
+
+// sendThrottle spaces out the sends of an account made through the api,
+// so that broadcasts stay below the rate limit of the server.
+type sendThrottle struct {
+	mu   sync.Mutex
+	last time.Time // slot of the latest send, may lie in the future
+}
+
+// wait reserves the next free slot and sleeps until it, without holding
+// the lock so concurrent requests just queue up behind each other. It
+// returns early with the error of ctx.
+func (throttle *sendThrottle) wait(ctx context.Context) error {
+	throttle.mu.Lock()
+	slot := throttle.last.Add(config.SendInterval)
+	if now := time.Now(); slot.Before(now) {
+		slot = now
+	}
+	throttle.last = slot
+	throttle.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(slot))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// deliver sends msg to every resolved recipient, recording the outcome in
+// results, and returns the number of failures. Messages the outbox queued
+// are no failures, the caller must not send them again. Recipients left
+// when ctx is done fail with its error.
+func (account *Account) deliver(ctx context.Context, identity string, remote string, kind string, msg interface{}, results []SendResult) int {
+	// Images are scaled and re-encoded once, not for every recipient
+	if media, ok := msg.(wechat.MediaMessage); ok {
+		if err := account.Core.PrepareMedia(&media); err != nil {
+			for i := range results {
+				if len(results[i].Error) == 0 {
+					results[i].Error = err.Error()
+				}
+			}
+			return len(results)
+		}
+		msg = media
+	}
+
+	failed := 0
+	for i := range results {
+		result := &results[i]
+		if len(result.Error) > 0 {
+			failed++
+			continue
+		}
+
+		if err := account.throttle.wait(ctx); err != nil {
+			result.Error = err.Error()
+			failed++
+			continue
+		}
+
+		resp, err := account.Core.SendMessage(msg, result.UserName)
+		auditSend(account, identity, remote, kind, result.UserName, err)
+		if errors.Is(err, wechat.ErrQueued) {
+			result.Queued = true
+			continue
+		}
+		if err != nil {
+			result.Error = err.Error()
+			failed++
+			continue
+		}
+		result.MsgID = resp.MsgID
+	}
+	return failed
+}
+
+// sendToRecipients sends msg to every resolved recipient and answers
+// with the result of each of them.
+func sendToRecipients(c *gin.Context, kind string, msg interface{}, results []SendResult) {
+	failed := accountOf(c).deliver(c.Request.Context(),
+		tokenName(requestToken(c)), c.ClientIP(), kind, msg, results)
+
+	queued := false
+	for _, result := range results {
+		queued = queued || result.Queued
+	}
+
+	switch {
+	case failed == 0 && queued:
+		c.IndentedJSON(http.StatusAccepted, SendResponse{
+			Msg: "queued", Results: results,
+		})
+	case failed == 0:
+		c.IndentedJSON(http.StatusOK, SendResponse{
+			Msg: "success", Results: results,
+		})
+	case failed < len(results):
+		c.IndentedJSON(http.StatusMultiStatus, SendResponse{
+			Msg: "partially failed", Results: results,
+		})
+	default:
+		c.IndentedJSON(http.StatusInternalServerError, SendResponse{
+			Msg: "failed", Results: results,
+		})
+	}
+}
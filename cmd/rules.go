@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/binarycraft007/wechat"
+	"gopkg.in/yaml.v3"
+)
+
+// Rule answers incoming messages. All conditions that are set have to
+// match, the first matching rule wins.
+type Rule struct {
+	Name     string        `yaml:"name"`
+	Chats    []string      `yaml:"chats"`   // UserName or display name
+	Senders  []string      `yaml:"senders"` // UserName or display name
+	MemberOf []string      `yaml:"member_of"`
+	InGroup  *bool         `yaml:"in_group"`
+	Types    []int         `yaml:"types"`
+	Keyword  string        `yaml:"keyword"`
+	Regex    string        `yaml:"regex"`
+	Mention  bool          `yaml:"mention"` // the bot is @-mentioned
+	Cooldown time.Duration `yaml:"cooldown"`
+	Reply    RuleReply     `yaml:"reply"`
+}
+
+type RuleReply struct {
+	Text    string `yaml:"text"` // text/template, see RuleContext
+	File    string `yaml:"file"`
+	Webhook string `yaml:"webhook"`
+}
+
+// RuleContext is the data reply templates are executed with.
+type RuleContext struct {
+	Sender         string
+	SenderUserName string
+	Chat           string
+	ChatUserName   string
+	Text           string
+	Time           time.Time
+	Captures       []string
+	Bot            string
+}
+
+type compiledRule struct {
+	Rule
+	regex    *regexp.Regexp
+	template *template.Template
+}
+
+type rulesFile struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+const (
+	ruleQueueSize = 64
+	ruleWorkers   = 4
+)
+
+type RuleEngine struct {
+	mu          sync.Mutex
+	configRules []*compiledRule
+	fileRules   []*compiledRule
+	cooldowns   map[string]time.Time // until when, by rule, account and chat
+	swept       time.Time            // last eviction of expired cooldowns
+	path        string
+	modTime     time.Time
+	replies     chan func()
+}
+
+var rules *RuleEngine
+
+func compileRules(rules []Rule) ([]*compiledRule, error) {
+	var compiled []*compiledRule
+	names := make(map[string]bool)
+
+	for i, rule := range rules {
+		name := rule.Name
+		if len(name) == 0 {
+			name = fmt.Sprintf("#%d", i+1)
+			rule.Name = name
+		}
+		if names[name] {
+			return nil, fmt.Errorf("rule %s: duplicate name", name)
+		}
+		names[name] = true
+
+		if len(rule.Reply.Text) == 0 && len(rule.Reply.File) == 0 &&
+			len(rule.Reply.Webhook) == 0 {
+			return nil, fmt.Errorf("rule %s: reply needs text, file or webhook", name)
+		}
+
+		if rule.Cooldown < 0 {
+			return nil, fmt.Errorf("rule %s: cooldown must not be negative", name)
+		}
+
+		compiledRule := compiledRule{Rule: rule}
+
+		if len(rule.Regex) > 0 {
+			regex, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: regex: %w", name, err)
+			}
+			compiledRule.regex = regex
+		}
+
+		if len(rule.Reply.Text) > 0 {
+			tmpl, err := template.New(name).Parse(rule.Reply.Text)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: text: %w", name, err)
+			}
+			compiledRule.template = tmpl
+		}
+
+		if len(rule.Reply.File) > 0 {
+			if _, err := os.Stat(rule.Reply.File); err != nil {
+				return nil, fmt.Errorf("rule %s: file: %w", name, err)
+			}
+		}
+
+		compiled = append(compiled, &compiledRule)
+	}
+
+	return compiled, nil
+}
+
+func loadRulesFile(path string) ([]*compiledRule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file rulesFile
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	compiled, err := compileRules(file.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return compiled, nil
+}
+
+func newRuleEngine(configRules []Rule, path string) (*RuleEngine, error) {
+	engine := RuleEngine{
+		cooldowns: make(map[string]time.Time),
+		path:      path,
+		replies:   make(chan func(), ruleQueueSize),
+	}
+
+	var err error
+	if engine.configRules, err = compileRules(configRules); err != nil {
+		return nil, err
+	}
+
+	if len(path) > 0 {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if engine.fileRules, err = loadRulesFile(path); err != nil {
+			return nil, err
+		}
+		engine.modTime = info.ModTime()
+	}
+
+	// Replies upload files and call webhooks, the sync loop must not
+	// wait for them
+	for i := 0; i < ruleWorkers; i++ {
+		go func() {
+			for reply := range engine.replies {
+				reply()
+			}
+		}()
+	}
+
+	return &engine, nil
+}
+
+// watch reloads the rules file whenever it changes.
+func (engine *RuleEngine) watch(interval time.Duration) {
+	if len(engine.path) == 0 {
+		return
+	}
+
+	for range time.Tick(interval) {
+		engine.reload()
+	}
+}
+
+// reload loads the rules file when it changed since the last load. A file
+// that fails to load is reported and the previous rules stay in place.
+func (engine *RuleEngine) reload() {
+	info, err := os.Stat(engine.path)
+	if err != nil {
+		logger.Error("rules reload failed", "file", engine.path, "err", err)
+		return
+	}
+
+	engine.mu.Lock()
+	changed := !info.ModTime().Equal(engine.modTime)
+	engine.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	fileRules, err := loadRulesFile(engine.path)
+
+	engine.mu.Lock()
+	engine.modTime = info.ModTime()
+	if err == nil {
+		engine.fileRules = fileRules
+	}
+	engine.mu.Unlock()
+
+	if err != nil {
+		logger.Error("rules reload failed", "file", engine.path, "err", err)
+	} else {
+		logger.Info("rules reloaded", "file", engine.path, "rules", len(fileRules))
+	}
+}
+
+func nameMatches(names []string, userName string, displayName string) bool {
+	for _, name := range names {
+		if name == userName || name == displayName {
+			return true
+		}
+	}
+	return false
+}
+
+func isGroupMember(core *wechat.Core, group string, userName string) bool {
+	for _, contact := range core.Contacts() {
+		if !wechat.IsGroup(contact.UserName) ||
+			(contact.NickName != group && contact.RemarkName != group &&
+				contact.UserName != group) {
+			continue
+		}
+		for _, member := range contact.MemberList {
+			if member.UserName == userName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isMentioned(core *wechat.Core, record wechat.HistoryRecord) bool {
+	names := []string{core.User.NickName}
+	if wechat.IsGroup(record.ChatUserName) {
+		names = append(names, core.MemberDisplayName(
+			record.ChatUserName, core.User.UserName))
+	}
+	for _, name := range names {
+		if len(name) > 0 && strings.Contains(record.Text, "@"+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the regex captures, the whole text when there is no
+// regex, or nil when rule does not apply to record received by core.
+func (rule *compiledRule) match(core *wechat.Core, record wechat.HistoryRecord) []string {
+	if len(rule.Chats) > 0 && !nameMatches(rule.Chats,
+		record.ChatUserName, record.ChatName) {
+		return nil
+	}
+
+	if len(rule.Senders) > 0 && !nameMatches(rule.Senders,
+		record.SenderUserName, record.SenderName) {
+		return nil
+	}
+
+	if rule.InGroup != nil && *rule.InGroup != wechat.IsGroup(record.ChatUserName) {
+		return nil
+	}
+
+	if len(rule.MemberOf) > 0 {
+		member := false
+		for _, group := range rule.MemberOf {
+			if isGroupMember(core, group, record.SenderUserName) {
+				member = true
+				break
+			}
+		}
+		if !member {
+			return nil
+		}
+	}
+
+	if len(rule.Types) > 0 {
+		found := false
+		for _, msgType := range rule.Types {
+			if msgType == record.MsgType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+
+	if len(rule.Keyword) > 0 && !strings.Contains(record.Text, rule.Keyword) {
+		return nil
+	}
+
+	if rule.Mention && !isMentioned(core, record) {
+		return nil
+	}
+
+	if rule.regex != nil {
+		return rule.regex.FindStringSubmatch(record.Text)
+	}
+
+	return []string{record.Text}
+}
+
+// Handle runs the first rule matching message received by account,
+// unless it is cooling down for the chat.
+func (engine *RuleEngine) Handle(account *Account, message wechat.Message) {
+	core := account.Core
+	record := core.NewHistoryRecord(message)
+	if record.Outgoing {
+		return
+	}
+
+	engine.mu.Lock()
+	all := append(append([]*compiledRule{}, engine.configRules...),
+		engine.fileRules...)
+
+	var rule *compiledRule
+	var captures []string
+	for _, candidate := range all {
+		if captures = candidate.match(core, record); captures != nil {
+			rule = candidate
+			break
+		}
+	}
+
+	if rule == nil {
+		engine.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(engine.swept) > time.Minute {
+		engine.evictCooldowns(now)
+	}
+
+	key := rule.Name + "/" + account.ID + "/" + record.ChatUserName
+	if until, ok := engine.cooldowns[key]; ok && now.Before(until) {
+		engine.mu.Unlock()
+		return
+	}
+	if rule.Cooldown > 0 {
+		engine.cooldowns[key] = now.Add(rule.Cooldown)
+	}
+	engine.mu.Unlock()
+
+	ctx := RuleContext{
+		Sender:         record.SenderName,
+		SenderUserName: record.SenderUserName,
+		Chat:           record.ChatName,
+		ChatUserName:   record.ChatUserName,
+		Text:           record.Text,
+		Time:           time.Unix(int64(record.CreateTime), 0),
+		Captures:       captures,
+		Bot:            core.User.NickName,
+	}
+
+	reply := func() {
+		if err := rule.reply(account, ctx, message); err != nil {
+			logger.Error("rule reply failed", "account", account.ID,
+				"rule", rule.Name, "chat", message.FromUserName,
+				"msg_id", message.MsgID, "err", err)
+		}
+	}
+
+	select {
+	case engine.replies <- reply:
+	default:
+		logger.Warn("rule reply queue full, reply dropped", "account", account.ID,
+			"rule", rule.Name, "msg_id", message.MsgID)
+	}
+}
+
+// evictCooldowns forgets the cooldowns that ran out, engine.mu is held.
+func (engine *RuleEngine) evictCooldowns(now time.Time) {
+	for key, until := range engine.cooldowns {
+		if !now.Before(until) {
+			delete(engine.cooldowns, key)
+		}
+	}
+	engine.swept = now
+}
+
+func (rule *compiledRule) reply(account *Account, ctx RuleContext, message wechat.Message) error {
+	core := account.Core
+	to := ctx.ChatUserName
+
+	if rule.template != nil {
+		var text bytes.Buffer
+		if err := rule.template.Execute(&text, ctx); err != nil {
+			return err
+		}
+		if err := core.SendMsg(text.String(), to); err != nil {
+			return err
+		}
+	}
+
+	if len(rule.Reply.File) > 0 {
+		data, err := ioutil.ReadFile(rule.Reply.File)
+		if err != nil {
+			return err
+		}
+		if err := core.SendMsg(wechat.MediaMessage{
+			Name:      filepath.Base(rule.Reply.File),
+			FileBytes: data,
+		}, to); err != nil {
+			return err
+		}
+	}
+
+	if len(rule.Reply.Webhook) > 0 {
+		event := account.newMessageEvent(message)
+		body, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		reply, err := webhooks.post(rule.Reply.Webhook, event.Type, body)
+		if err != nil {
+			return err
+		}
+		if len(reply.Reply) > 0 {
+			if err := core.SendMsg(reply.Reply, to); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
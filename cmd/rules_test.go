@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/binarycraft007/wechat"
+)
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (fn roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return fn(req)
+}
+
+// newTestCore returns a Core logged in as @bot ("Bot") with contacts,
+// loaded through a faked contact list request.
+func newTestCore(t *testing.T, contacts []wechat.Contact) *wechat.Core {
+	t.Helper()
+
+	list, err := json.Marshal(wechat.GetContactResponse{MemberList: contacts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	core, err := wechat.New(wechat.CoreOption{
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(bytes.NewReader(list)),
+				Request:    req,
+			}, nil
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := core.GetContact(); err != nil {
+		t.Fatal(err)
+	}
+	core.User.UserName = "@bot"
+	core.User.NickName = "Bot"
+	return core
+}
+
+var testContacts = []wechat.Contact{
+	{UserName: "@alice", NickName: "Alice"},
+	{UserName: "@bob", NickName: "Bob"},
+	{UserName: "@@ops", NickName: "Ops", MemberCount: 2,
+		MemberList: []wechat.Contact{
+			{UserName: "@alice", NickName: "Alice"},
+			{UserName: "@bot", NickName: "Bot", DisplayName: "Helper"},
+		}},
+}
+
+func textRecord(core *wechat.Core, from string, content string) wechat.HistoryRecord {
+	return core.NewHistoryRecord(wechat.Message{
+		FromUserName: from,
+		ToUserName:   "@bot",
+		MsgType:      int(wechat.Text),
+		Content:      content,
+	})
+}
+
+func TestRuleMatch(t *testing.T) {
+	core := newTestCore(t, testContacts)
+	yes, no := true, false
+
+	image := textRecord(core, "@alice", "")
+	image.MsgType = int(wechat.Image)
+
+	tests := []struct {
+		name   string
+		rule   Rule
+		record wechat.HistoryRecord
+		want   []string
+	}{
+		{"no conditions", Rule{},
+			textRecord(core, "@alice", "hi"), []string{"hi"}},
+		{"keyword", Rule{Keyword: "deploy"},
+			textRecord(core, "@alice", "please deploy"), []string{"please deploy"}},
+		{"keyword missing", Rule{Keyword: "deploy"},
+			textRecord(core, "@alice", "hello"), nil},
+		{"regex captures", Rule{Regex: `^deploy (\w+) (\w+)$`},
+			textRecord(core, "@alice", "deploy api prod"),
+			[]string{"deploy api prod", "api", "prod"}},
+		{"regex no match", Rule{Regex: `^deploy (\w+)$`},
+			textRecord(core, "@alice", "status"), nil},
+		{"chat by name", Rule{Chats: []string{"Alice"}},
+			textRecord(core, "@alice", "hi"), []string{"hi"}},
+		{"other chat", Rule{Chats: []string{"Bob"}},
+			textRecord(core, "@alice", "hi"), nil},
+		{"sender by username", Rule{Senders: []string{"@alice"}},
+			textRecord(core, "@@ops", "@alice:<br/>hi"), []string{"hi"}},
+		{"in group", Rule{InGroup: &yes},
+			textRecord(core, "@@ops", "@alice:<br/>hi"), []string{"hi"}},
+		{"in group, direct", Rule{InGroup: &yes},
+			textRecord(core, "@alice", "hi"), nil},
+		{"not in group", Rule{InGroup: &no},
+			textRecord(core, "@alice", "hi"), []string{"hi"}},
+		{"member of", Rule{MemberOf: []string{"Ops"}},
+			textRecord(core, "@alice", "hi"), []string{"hi"}},
+		{"not a member", Rule{MemberOf: []string{"Ops"}},
+			textRecord(core, "@bob", "hi"), nil},
+		{"mention by nickname", Rule{Mention: true},
+			textRecord(core, "@@ops", "@alice:<br/>@Bot help"), []string{"@Bot help"}},
+		{"mention by group name", Rule{Mention: true},
+			textRecord(core, "@@ops", "@alice:<br/>@Helper help"), []string{"@Helper help"}},
+		{"no mention", Rule{Mention: true},
+			textRecord(core, "@@ops", "@alice:<br/>help"), nil},
+		{"type", Rule{Types: []int{int(wechat.Image)}},
+			image, []string{""}},
+		{"other type", Rule{Types: []int{int(wechat.Image)}},
+			textRecord(core, "@alice", "hi"), nil},
+	}
+
+	for _, test := range tests {
+		test.rule.Reply.Text = "ok"
+		compiled, err := compileRules([]Rule{test.rule})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := compiled[0].match(core, test.record); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: match = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRuleTemplate(t *testing.T) {
+	compiled, err := compileRules([]Rule{{
+		Regex: `^deploy (\w+)$`,
+		Reply: RuleReply{Text: `{{.Sender}} asked {{.Bot}} for {{index .Captures 1}}`},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var text bytes.Buffer
+	err = compiled[0].template.Execute(&text, RuleContext{
+		Sender:   "Alice",
+		Bot:      "Bot",
+		Captures: []string{"deploy prod", "prod"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Alice asked Bot for prod"; text.String() != want {
+		t.Errorf("reply %q, want %q", text.String(), want)
+	}
+}
+
+func TestCompileRulesErrors(t *testing.T) {
+	tests := []Rule{
+		{Name: "no reply"},
+		{Regex: "(", Reply: RuleReply{Text: "x"}},
+		{Reply: RuleReply{Text: "{{"}},
+		{Cooldown: -time.Second, Reply: RuleReply{Text: "x"}},
+		{Reply: RuleReply{File: "does-not-exist"}},
+	}
+
+	for _, rule := range tests {
+		if _, err := compileRules([]Rule{rule}); err == nil {
+			t.Errorf("rule %+v compiled", rule)
+		}
+	}
+	if _, err := compileRules([]Rule{
+		{Name: "a", Reply: RuleReply{Text: "x"}},
+		{Name: "a", Reply: RuleReply{Text: "y"}},
+	}); err == nil {
+		t.Error("duplicate names compiled")
+	}
+}
+
+func TestRuleEngineHandle(t *testing.T) {
+	core := newTestCore(t, testContacts)
+	account := &Account{ID: DefaultAccountID, Core: core}
+
+	configRules, err := compileRules([]Rule{
+		{Name: "ping", Keyword: "ping", Cooldown: time.Hour,
+			Reply: RuleReply{Text: "pong"}},
+		{Name: "any", Reply: RuleReply{Text: "hello"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No workers, the test counts the queued replies
+	engine := &RuleEngine{
+		configRules: configRules,
+		cooldowns:   make(map[string]time.Time),
+		replies:     make(chan func(), 16),
+	}
+
+	message := func(from string, to string, content string) wechat.Message {
+		return wechat.Message{FromUserName: from, ToUserName: to,
+			MsgType: int(wechat.Text), Content: content}
+	}
+
+	tests := []struct {
+		name     string
+		message  wechat.Message
+		replies  int
+		cooldown string
+	}{
+		{"first match", message("@alice", "@bot", "ping"), 1, "ping/default/@alice"},
+		{"cooling down", message("@alice", "@bot", "ping"), 0, ""},
+		{"other chat", message("@bob", "@bot", "ping"), 1, "ping/default/@bob"},
+		{"next rule", message("@alice", "@bot", "hi"), 1, ""},
+		{"outgoing", message("@bot", "@alice", "hi"), 0, ""},
+	}
+
+	for _, test := range tests {
+		before := len(engine.replies)
+		engine.Handle(account, test.message)
+		if got := len(engine.replies) - before; got != test.replies {
+			t.Errorf("%s: %d replies queued, want %d", test.name, got, test.replies)
+		}
+		if len(test.cooldown) > 0 {
+			if _, ok := engine.cooldowns[test.cooldown]; !ok {
+				t.Errorf("%s: no cooldown %s", test.name, test.cooldown)
+			}
+		}
+	}
+}
+
+func TestRuleEngineReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	write := func(content string, modTime time.Time) {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	names := func(engine *RuleEngine) string {
+		var names []string
+		for _, rule := range engine.fileRules {
+			names = append(names, rule.Name)
+		}
+		return strings.Join(names, ",")
+	}
+
+	start := time.Now().Add(-time.Hour)
+	write("rules:\n  - name: old\n    reply: {text: x}\n", start)
+	engine, err := newRuleEngine(nil, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("rules:\n  - name: new\n    reply: {text: x}\n", start.Add(time.Minute))
+	engine.reload()
+	if got := names(engine); got != "new" {
+		t.Errorf("rules after a change %q, want new", got)
+	}
+
+	write("rules: [", start.Add(2*time.Minute))
+	engine.reload()
+	if got := names(engine); got != "new" {
+		t.Errorf("rules after a broken file %q, want new kept", got)
+	}
+}
+
+func TestRuleEngineEvictsCooldowns(t *testing.T) {
+	engine, err := newRuleEngine(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	engine.cooldowns["expired/default/@a"] = now.Add(-time.Second)
+	engine.cooldowns["running/default/@a"] = now.Add(time.Minute)
+	engine.evictCooldowns(now)
+
+	if _, ok := engine.cooldowns["expired/default/@a"]; ok {
+		t.Error("expired cooldown kept")
+	}
+	if _, ok := engine.cooldowns["running/default/@a"]; !ok {
+		t.Error("running cooldown evicted")
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/binarycraft007/wechat"
+	"github.com/gin-gonic/gin"
+)
+
+const maxScheduleRuns = 20
+
+// errNotLoggedIn is the error of runs while the account is logged out,
+// one-shot schedules stay due and are sent after the next login.
+const errNotLoggedIn = "not logged in"
+
+type Schedule struct {
+	ID         string        `json:"id"`
+	Cron       string        `json:"cron,omitempty"`
+	At         *time.Time    `json:"at,omitempty"`
+	To         []Recipient   `json:"to,omitempty"`
+	Tag        string        `json:"tag,omitempty"`
+	Text       string        `json:"text,omitempty"`
+	FileName   string        `json:"file_name,omitempty"`
+	FileData   []byte        `json:"file_data,omitempty"`
+	FileSize   int           `json:"file_size,omitempty"`
+	Token      string        `json:"token,omitempty"`
+	CreateTime time.Time     `json:"create_time"`
+	NextRun    *time.Time    `json:"next_run,omitempty"`
+	Runs       []ScheduleRun `json:"runs"`
+	spec       *CronSpec
+}
+
+type ScheduleRun struct {
+	Time    time.Time    `json:"time"`
+	Error   string       `json:"error,omitempty"`
+	Results []SendResult `json:"results,omitempty"`
+}
+
+// Scheduler sends the messages of its schedules from its account when
+// they are due and keeps them, with the outcome of their runs, in a JSON
+// file.
+type Scheduler struct {
+	mu        sync.Mutex
+	account   *Account
+	path      string
+	schedules map[string]*Schedule
+}
+
+func newScheduler(account *Account, path string) (*Scheduler, error) {
+	s := Scheduler{
+		account:   account,
+		path:      path,
+		schedules: make(map[string]*Schedule),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var schedules []*Schedule
+	if err := json.Unmarshal(data, &schedules); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for _, schedule := range schedules {
+		if len(schedule.Cron) > 0 {
+			if schedule.spec, err = ParseCron(schedule.Cron); err != nil {
+				return nil, err
+			}
+			// Runs missed while we were down are skipped
+			if schedule.NextRun != nil && schedule.NextRun.Before(now) {
+				next := schedule.spec.Next(now)
+				schedule.NextRun = &next
+			}
+		}
+		s.schedules[schedule.ID] = schedule
+	}
+
+	return &s, nil
+}
+
+// save must be called with the lock held.
+func (s *Scheduler) save() error {
+	schedules := make([]*Schedule, 0, len(s.schedules))
+	for _, schedule := range s.schedules {
+		schedules = append(schedules, schedule)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].CreateTime.Before(schedules[j].CreateTime)
+	})
+
+	data, err := json.MarshalIndent(schedules, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
+
+func (s *Scheduler) Add(schedule *Schedule) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.schedules[schedule.ID] = schedule
+	return s.save()
+}
+
+func (s *Scheduler) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.schedules, id)
+	return s.save()
+}
+
+func (s *Scheduler) Get(id string) (Schedule, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedule, ok := s.schedules[id]
+	if !ok {
+		return Schedule{}, false
+	}
+	return schedule.view(), true
+}
+
+func (s *Scheduler) List() []Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedules := []Schedule{}
+	for _, schedule := range s.schedules {
+		schedules = append(schedules, schedule.view())
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].CreateTime.Before(schedules[j].CreateTime)
+	})
+	return schedules
+}
+
+// view is a copy of schedule without the file content.
+func (schedule *Schedule) view() Schedule {
+	view := *schedule
+	view.FileSize = len(view.FileData)
+	view.FileData = nil
+	view.Runs = append([]ScheduleRun{}, schedule.Runs...)
+	return view
+}
+
+func (s *Scheduler) run(ctx context.Context) {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			for _, schedule := range s.due(now) {
+				run := s.execute(ctx, schedule)
+				s.finish(schedule.ID, run)
+			}
+		}
+	}
+}
+
+func (s *Scheduler) due(now time.Time) []Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []Schedule
+	for _, schedule := range s.schedules {
+		if schedule.NextRun != nil && !schedule.NextRun.After(now) {
+			due = append(due, *schedule)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].NextRun.Before(*due[j].NextRun)
+	})
+	return due
+}
+
+func (s *Scheduler) execute(ctx context.Context, schedule Schedule) ScheduleRun {
+	run := ScheduleRun{Time: time.Now()}
+
+	if s.account.Core.LoginState() != wechat.LoggedIn {
+		run.Error = errNotLoggedIn
+		return run
+	}
+
+	var token *Token
+	if len(tokens) > 0 {
+		for i := range tokens {
+			if tokens[i].Name == schedule.Token {
+				token = &tokens[i]
+			}
+		}
+		if token == nil {
+			run.Error = "token no longer exists: " + schedule.Token
+			return run
+		}
+	}
+
+	results, err := selectRecipients(s.account.Core, SendMessageRequest{
+		To:  schedule.To,
+		Tag: schedule.Tag,
+	}, token)
+	if err != nil {
+		run.Error = err.Error()
+		return run
+	}
+
+	identity := "schedule:" + schedule.ID + "/" + tokenName(token)
+	if len(schedule.Text) > 0 {
+		textResults := append([]SendResult{}, results...)
+		s.account.deliver(ctx, identity, "scheduler", "text", schedule.Text, textResults)
+		run.Results = append(run.Results, textResults...)
+	}
+	if len(schedule.FileData) > 0 {
+		fileResults := append([]SendResult{}, results...)
+		s.account.deliver(ctx, identity, "scheduler", "file", wechat.MediaMessage{
+			Name:      schedule.FileName,
+			FileBytes: schedule.FileData,
+		}, fileResults)
+		run.Results = append(run.Results, fileResults...)
+	}
+
+	return run
+}
+
+func (s *Scheduler) finish(id string, run ScheduleRun) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	schedule, ok := s.schedules[id]
+	if !ok {
+		return // deleted while running
+	}
+
+	retry := schedule.spec == nil && run.Error == errNotLoggedIn
+	// Waiting for a login is recorded once, not on every tick
+	if !retry || len(schedule.Runs) == 0 ||
+		schedule.Runs[len(schedule.Runs)-1].Error != errNotLoggedIn {
+		schedule.Runs = append(schedule.Runs, run)
+	}
+	if len(schedule.Runs) > maxScheduleRuns {
+		schedule.Runs = schedule.Runs[len(schedule.Runs)-maxScheduleRuns:]
+	}
+
+	if schedule.spec != nil {
+		next := schedule.spec.Next(time.Now())
+		schedule.NextRun = &next
+		if next.IsZero() {
+			schedule.NextRun = nil
+		}
+	} else if !retry {
+		schedule.NextRun = nil
+	}
+
+	if err := s.save(); err != nil {
+		logger.Error("save schedules failed", "account", s.account.ID,
+			"file", s.path, "err", err)
+	}
+}
+
+func newScheduleID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// canManage reports whether the token of the request owns schedule.
+func canManage(c *gin.Context, schedule Schedule) bool {
+	token := requestToken(c)
+	return token == nil || token.hasScope(ScopeAdmin) ||
+		token.Name == schedule.Token
+}
+
+func createScheduleHandler(c *gin.Context) {
+	var schedule Schedule
+	if err := c.ShouldBindJSON(&schedule); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, Message{Msg: err.Error()})
+		return
+	}
+
+	now := time.Now()
+	var errMsg string
+	switch {
+	case len(schedule.Cron) > 0 && schedule.At != nil:
+		errMsg = "set either cron or at, not both"
+	case len(schedule.Cron) == 0 && schedule.At == nil:
+		errMsg = "cron or at is required"
+	case schedule.At != nil && schedule.At.Before(now):
+		errMsg = "at is in the past"
+	case len(schedule.Text) == 0 && len(schedule.FileData) == 0:
+		errMsg = "text or file_data is required"
+	case len(schedule.FileData) > 0 && len(schedule.FileName) == 0:
+		errMsg = "file_name is required with file_data"
+	case len(schedule.To) == 0 && len(schedule.Tag) == 0:
+		errMsg = "to or tag is required"
+	}
+	if len(errMsg) == 0 && len(schedule.Tag) > 0 {
+		if _, ok := config.Tags[schedule.Tag]; !ok {
+			errMsg = "unknown tag: " + schedule.Tag
+		}
+	}
+	if len(errMsg) == 0 {
+		for _, recipient := range schedule.To {
+			if err := recipient.validate(); err != nil {
+				errMsg = recipient.String() + ": " + err.Error()
+				break
+			}
+		}
+	}
+	if len(errMsg) > 0 {
+		c.IndentedJSON(http.StatusBadRequest, Message{Msg: errMsg})
+		return
+	}
+
+	token := requestToken(c)
+	if len(schedule.FileData) > 0 && token != nil &&
+		!token.hasScope(ScopeSendFile) {
+		c.IndentedJSON(http.StatusForbidden, Message{
+			Msg: "token lacks scope: " + ScopeSendFile,
+		})
+		return
+	}
+
+	if len(schedule.Cron) > 0 {
+		spec, err := ParseCron(schedule.Cron)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, Message{Msg: err.Error()})
+			return
+		}
+		next := spec.Next(now)
+		if next.IsZero() {
+			c.IndentedJSON(http.StatusBadRequest, Message{
+				Msg: "cron never matches: " + schedule.Cron,
+			})
+			return
+		}
+		schedule.spec = spec
+		schedule.NextRun = &next
+	} else {
+		schedule.NextRun = schedule.At
+	}
+
+	schedule.ID = newScheduleID()
+	schedule.Token = tokenName(token)
+	schedule.CreateTime = now
+	schedule.Runs = nil
+
+	if err := accountOf(c).Scheduler.Add(&schedule); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, Message{
+			Msg: err.Error(),
+		})
+		return
+	}
+
+	c.IndentedJSON(http.StatusCreated, schedule.view())
+}
+
+func listSchedulesHandler(c *gin.Context) {
+	schedules := []Schedule{}
+	for _, schedule := range accountOf(c).Scheduler.List() {
+		if canManage(c, schedule) {
+			schedules = append(schedules, schedule)
+		}
+	}
+	c.IndentedJSON(http.StatusOK, schedules)
+}
+
+func getScheduleHandler(c *gin.Context) {
+	schedule, ok := accountOf(c).Scheduler.Get(c.Param("id"))
+	if !ok || !canManage(c, schedule) {
+		c.IndentedJSON(http.StatusNotFound, Message{
+			Msg: "schedule not found: " + c.Param("id"),
+		})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, schedule)
+}
+
+func deleteScheduleHandler(c *gin.Context) {
+	scheduler := accountOf(c).Scheduler
+	schedule, ok := scheduler.Get(c.Param("id"))
+	if !ok || !canManage(c, schedule) {
+		c.IndentedJSON(http.StatusNotFound, Message{
+			Msg: "schedule not found: " + c.Param("id"),
+		})
+		return
+	}
+
+	if err := scheduler.Remove(schedule.ID); err != nil {
+		c.IndentedJSON(http.StatusInternalServerError, Message{
+			Msg: err.Error(),
+		})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, Message{Msg: "success"})
+}
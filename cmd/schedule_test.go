@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/binarycraft007/wechat"
+)
+
+func TestScheduleAtWaitsForLogin(t *testing.T) {
+	core, err := wechat.New(wechat.CoreOption{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := &Account{ID: DefaultAccountID, Core: core}
+	scheduler, err := newScheduler(account,
+		filepath.Join(t.TempDir(), "schedules.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	at := time.Now().Add(-time.Second)
+	if err := scheduler.Add(&Schedule{ID: "once", At: &at, NextRun: &at,
+		Text: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		due := scheduler.due(time.Now())
+		if len(due) != 1 {
+			t.Fatalf("tick %d: %d schedules due, want 1", i, len(due))
+		}
+		scheduler.finish(due[0].ID, scheduler.execute(context.Background(), due[0]))
+	}
+
+	schedule, _ := scheduler.Get("once")
+	if schedule.NextRun == nil || !schedule.NextRun.Equal(at) {
+		t.Errorf("next run %v, want %v", schedule.NextRun, at)
+	}
+	if len(schedule.Runs) != 1 || schedule.Runs[0].Error != errNotLoggedIn {
+		t.Errorf("runs %+v, want one %q", schedule.Runs, errNotLoggedIn)
+	}
+}
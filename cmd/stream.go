@@ -0,0 +1,243 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+const eventBacklogSize = 1024
+
+// EventHub numbers every event and fans it out to the connected streams.
+// The newest events are kept so that clients can resume from a cursor.
+type EventHub struct {
+	mu          sync.Mutex
+	lastID      uint64
+	backlog     []Event
+	subscribers map[chan Event]bool
+}
+
+// newEventHub numbers events from the boot time in microseconds, so ids
+// keep growing across restarts and cursors of an earlier run still work.
+// They stay below 2^53 to survive JSON numbers in JavaScript.
+func newEventHub() *EventHub {
+	return &EventHub{
+		lastID:      uint64(time.Now().UnixMicro()),
+		subscribers: make(map[chan Event]bool),
+	}
+}
+
+func (hub *EventHub) Publish(event Event) Event {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	hub.lastID++
+	event.ID = hub.lastID
+
+	hub.backlog = append(hub.backlog, event)
+	if len(hub.backlog) > eventBacklogSize {
+		hub.backlog = hub.backlog[len(hub.backlog)-eventBacklogSize:]
+	}
+
+	for subscriber := range hub.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			// Too slow, the client has to reconnect with its cursor
+			delete(hub.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+
+	return event
+}
+
+// Subscribe returns the buffered events after cursor and a channel for
+// the following ones.
+func (hub *EventHub) Subscribe(cursor uint64) ([]Event, chan Event) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	var missed []Event
+	for _, event := range hub.backlog {
+		if event.ID > cursor {
+			missed = append(missed, event)
+		}
+	}
+
+	subscriber := make(chan Event, 64)
+	hub.subscribers[subscriber] = true
+	return missed, subscriber
+}
+
+func (hub *EventHub) Unsubscribe(subscriber chan Event) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if hub.subscribers[subscriber] {
+		delete(hub.subscribers, subscriber)
+		close(subscriber)
+	}
+}
+
+type eventFilter struct {
+	chat     string
+	msgTypes map[int]bool
+}
+
+func newEventFilter(c *gin.Context) eventFilter {
+	filter := eventFilter{chat: c.Query("chat")}
+
+	for _, value := range strings.Split(c.Query("type"), ",") {
+		msgType, err := strconv.Atoi(value)
+		if err != nil {
+			continue
+		}
+		if filter.msgTypes == nil {
+			filter.msgTypes = make(map[int]bool)
+		}
+		filter.msgTypes[msgType] = true
+	}
+
+	return filter
+}
+
+func (filter eventFilter) match(event Event) bool {
+	switch event.Type {
+	case EventLoginState, EventLogout:
+		return true // session events concern every chat
+	}
+
+	if msg := event.Message; msg != nil {
+		if filter.msgTypes != nil && !filter.msgTypes[msg.MsgType] {
+			return false
+		}
+		if len(filter.chat) == 0 {
+			return true
+		}
+		for _, name := range []string{
+			msg.GroupUserName, msg.GroupName,
+			msg.FromUserName, msg.FromName,
+			msg.ToUserName, msg.ToName,
+		} {
+			if len(name) > 0 && name == filter.chat {
+				return true
+			}
+		}
+		return false
+	}
+
+	if contact := event.Contact; contact != nil && len(filter.chat) > 0 {
+		return contact.UserName == filter.chat ||
+			contact.NickName == filter.chat ||
+			contact.RemarkName == filter.chat
+	}
+
+	return true
+}
+
+func eventCursor(c *gin.Context) uint64 {
+	value := c.Query("cursor")
+	if len(value) == 0 {
+		value = c.GetHeader("Last-Event-ID")
+	}
+	cursor, _ := strconv.ParseUint(value, 10, 64)
+	return cursor
+}
+
+func sseHandler(c *gin.Context) {
+	filter := newEventFilter(c)
+	hub := accountOf(c).Hub
+	missed, subscriber := hub.Subscribe(eventCursor(c))
+	defer hub.Unsubscribe(subscriber)
+
+	render := func(event Event) {
+		if filter.match(event) {
+			c.Render(-1, sse.Event{
+				Id:    strconv.FormatUint(event.ID, 10),
+				Event: event.Type,
+				Data:  event,
+			})
+		}
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	for _, event := range missed {
+		render(event)
+	}
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event, ok := <-subscriber:
+			if !ok {
+				return false
+			}
+			render(event)
+		case <-keepAlive.C:
+			w.Write([]byte(":\n\n"))
+		case <-c.Request.Context().Done():
+			return false
+		}
+		return true
+	})
+}
+
+func wsHandler(c *gin.Context) {
+	filter := newEventFilter(c)
+	cursor := eventCursor(c)
+	hub := accountOf(c).Hub
+
+	server := websocket.Server{Handler: func(ws *websocket.Conn) {
+		defer ws.Close()
+
+		missed, subscriber := hub.Subscribe(cursor)
+		defer hub.Unsubscribe(subscriber)
+
+		// Reading is only needed to notice the client going away
+		closed := make(chan struct{})
+		go func() {
+			var discard []byte
+			for websocket.Message.Receive(ws, &discard) == nil {
+			}
+			close(closed)
+		}()
+
+		for _, event := range missed {
+			if filter.match(event) {
+				if err := websocket.JSON.Send(ws, event); err != nil {
+					return
+				}
+			}
+		}
+
+		for {
+			select {
+			case event, ok := <-subscriber:
+				if !ok {
+					return
+				}
+				if !filter.match(event) {
+					continue
+				}
+				if err := websocket.JSON.Send(ws, event); err != nil {
+					return
+				}
+			case <-closed:
+				return
+			}
+		}
+	}}
+
+	server.ServeHTTP(c.Writer, c.Request)
+}
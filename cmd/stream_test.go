@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventFilterMatch(t *testing.T) {
+	filter := eventFilter{chat: "alice", msgTypes: map[int]bool{1: true}}
+
+	tests := []struct {
+		name  string
+		event Event
+		want  bool
+	}{
+		{"message in chat", Event{Type: EventMessageRecv,
+			Message: &EventMessage{MsgType: 1, FromName: "alice"}}, true},
+		{"message in other chat", Event{Type: EventMessageRecv,
+			Message: &EventMessage{MsgType: 1, FromName: "bob"}}, false},
+		{"message of other type", Event{Type: EventMessageRecv,
+			Message: &EventMessage{MsgType: 3, FromName: "alice"}}, false},
+		{"contact in chat", Event{Type: EventContactMod,
+			Contact: &EventContact{RemarkName: "alice"}}, true},
+		{"contact in other chat", Event{Type: EventContactDel,
+			Contact: &EventContact{NickName: "bob"}}, false},
+		{"login state", Event{Type: EventLoginState, State: "logged_in",
+			Contact: &EventContact{NickName: "me"}}, true},
+		{"logout", Event{Type: EventLogout,
+			Contact: &EventContact{NickName: "me"}}, true},
+	}
+
+	for _, test := range tests {
+		if got := filter.match(test.event); got != test.want {
+			t.Errorf("%s: match = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestEventHubIDsGrowAcrossRestarts(t *testing.T) {
+	first := newEventHub().Publish(Event{Type: EventLogout})
+	time.Sleep(time.Millisecond)
+	second := newEventHub().Publish(Event{Type: EventLogout})
+
+	if second.ID <= first.ID {
+		t.Errorf("id after restart %d, want more than %d", second.ID, first.ID)
+	}
+	if second.ID >= 1<<53 {
+		t.Errorf("id %d does not fit a JSON number", second.ID)
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"log"
 	"strings"
 	"time"
 
@@ -15,54 +14,66 @@ type PingMessage struct {
 }
 
 type PeriodicSyncOption struct {
-	Cancel context.CancelFunc
-	Period time.Duration
+	Context context.Context
+	Core    *wechat.Core
+	Period  time.Duration
 }
 
-func periodicSync(options PeriodicSyncOption) {
+// periodicSync polls until the context is done or the session is gone.
+func periodicSync(options PeriodicSyncOption) error {
 	var errSlice []bool
-	t := time.NewTicker(options.Period * time.Millisecond)
+	t := time.NewTicker(options.Period)
 	defer t.Stop()
 	for {
 		select {
+		case <-options.Context.Done():
+			return nil
 		case <-t.C: // Activate periodically
 			var err error
-			if err = core.SyncPolling(); err == nil {
-				if len(errSlice) >= 10 {
-					options.Cancel()
-				}
+			if err = options.Core.SyncPolling(); err == nil {
 				errSlice = nil
 				continue
 			}
 			if err == wechat.ErrAlreadyLoggedOut {
 				if len(errSlice) >= 10 {
-					options.Cancel()
+					return err
 				}
 				errSlice = append(errSlice, true)
 			} else {
-				log.Println("sync error:", err.Error())
+				options.Core.Logger.Error("sync failed", "err", err)
 			}
 		}
 	}
 }
 
-func onMsgRecv(data *wechat.SyncResponse) error {
+func (account *Account) onMsgRecv(data *wechat.SyncResponse) error {
+	core := account.Core
 	for _, message := range data.AddMsgList {
+		account.publishEvent(account.newMessageEvent(message))
+
 		if len(message.Content) == 0 {
-			return nil
+			continue
+		}
+
+		if message.FromUserName == core.User.UserName {
+			continue // never answer ourselves
 		}
 
 		pingMsg := extractPingMessage(message.Content)
 		userNick := core.User.NickName
 
-		if pingMsg != nil &&
+		if pingMsg != nil && len(config.AutoReply.PingReply) > 0 &&
 			strings.HasPrefix(pingMsg.ToNickName, userNick) {
 			to := message.FromUserName
-			msg := "What can I do for you?"
+			msg := config.AutoReply.PingReply
 			if err := core.SendMsg(msg, to); err != nil {
-				log.Println("Send message error:", err)
+				logger.Error("ping reply failed", "account", account.ID,
+					"chat", to, "err", err)
 			}
+			continue
 		}
+
+		rules.Handle(account, message)
 	}
 	return nil
 }
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	webhookQueueSize  = 256
+	webhookWorkers    = 4 // per url
+	webhookMaxBackoff = time.Minute
+)
+
+type WebhookOption struct {
+	URLs    []string
+	Secret  string
+	Retries int
+	Reply   bool
+}
+
+type Webhooks struct {
+	options WebhookOption
+	client  *http.Client
+	targets []*webhookTarget
+}
+
+// webhookTarget is the queue of one url. Failed deliveries wait for their
+// retry outside of it, at most webhookQueueSize of them.
+type webhookTarget struct {
+	url     string
+	queue   chan webhookDelivery
+	retries atomic.Int32
+}
+
+type webhookDelivery struct {
+	event   Event
+	body    []byte
+	attempt int
+}
+
+type webhookError struct {
+	statusCode int
+}
+
+func (err webhookError) Error() string {
+	return fmt.Sprintf("webhook returned status %d", err.statusCode)
+}
+
+var webhooks *Webhooks
+
+func newWebhooks(options WebhookOption) *Webhooks {
+	hooks := Webhooks{
+		options: options,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+
+	for _, url := range options.URLs {
+		target := webhookTarget{
+			url:   url,
+			queue: make(chan webhookDelivery, webhookQueueSize),
+		}
+		hooks.targets = append(hooks.targets, &target)
+		for i := 0; i < webhookWorkers; i++ {
+			go hooks.run(&target)
+		}
+	}
+
+	return &hooks
+}
+
+// Deliver queues event for every webhook without blocking the sync loop,
+// events are dropped when a webhook falls too far behind.
+func (hooks *Webhooks) Deliver(event Event) {
+	if hooks == nil || len(hooks.targets) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		logger.Error("webhook marshal failed", "event", event.ID, "err", err)
+		return
+	}
+
+	for _, target := range hooks.targets {
+		target.enqueue(webhookDelivery{event: event, body: body})
+	}
+}
+
+func (target *webhookTarget) enqueue(delivery webhookDelivery) {
+	select {
+	case target.queue <- delivery:
+	default:
+		logger.Warn("webhook queue full, event dropped",
+			"url", target.url, "event", delivery.event.ID)
+	}
+}
+
+func (hooks *Webhooks) run(target *webhookTarget) {
+	for delivery := range target.queue {
+		reply, err := hooks.post(target.url, delivery.event.Type, delivery.body)
+		if err != nil {
+			hooks.retry(target, delivery, err)
+			continue
+		}
+
+		if hooks.options.Reply {
+			hooks.sendReply(delivery.event, reply)
+		}
+	}
+}
+
+// retry queues delivery again after a backoff unless err is final, the
+// retries are used up or too many deliveries are waiting already.
+func (hooks *Webhooks) retry(target *webhookTarget, delivery webhookDelivery, err error) {
+	// Client errors will not go away by retrying
+	final := false
+	if webhookErr, ok := err.(webhookError); ok &&
+		webhookErr.statusCode < 500 &&
+		webhookErr.statusCode != http.StatusTooManyRequests {
+		final = true
+	}
+
+	if final || delivery.attempt >= hooks.options.Retries {
+		logger.Error("webhook delivery failed", "url", target.url,
+			"event", delivery.event.ID, "err", err)
+		return
+	}
+	if target.retries.Add(1) > webhookQueueSize {
+		target.retries.Add(-1)
+		logger.Error("webhook delivery failed, too many retries pending",
+			"url", target.url, "event", delivery.event.ID, "err", err)
+		return
+	}
+
+	backoff := webhookMaxBackoff
+	if delivery.attempt < 6 {
+		backoff = minDuration(time.Second<<delivery.attempt, webhookMaxBackoff)
+	}
+	delivery.attempt++
+	time.AfterFunc(backoff, func() {
+		target.retries.Add(-1)
+		target.enqueue(delivery)
+	})
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (hooks *Webhooks) post(url string, eventType string, body []byte) (*WebhookReply, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Wechat-Event", eventType)
+
+	if len(hooks.options.Secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Wechat-Timestamp", timestamp)
+		req.Header.Set("X-Wechat-Signature",
+			"sha256="+signWebhook(hooks.options.Secret, timestamp, body))
+	}
+
+	resp, err := hooks.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, webhookError{statusCode: resp.StatusCode}
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var reply WebhookReply
+	if len(respBody) > 0 {
+		// Anything else than a reply object is simply not a reply
+		json.Unmarshal(respBody, &reply)
+	}
+
+	return &reply, nil
+}
+
+func (hooks *Webhooks) sendReply(event Event, reply *WebhookReply) {
+	if event.Message == nil || event.Message.Outgoing ||
+		reply == nil || len(reply.Reply) == 0 {
+		return
+	}
+
+	account, ok := accounts.Get(event.Account)
+	if !ok {
+		return
+	}
+
+	to := event.Message.FromUserName
+	if len(event.Message.GroupUserName) > 0 {
+		to = event.Message.GroupUserName
+	}
+
+	if err := account.Core.SendMsg(reply.Reply, to); err != nil {
+		logger.Error("webhook reply failed", "account", account.ID,
+			"chat", to, "err", err)
+	}
+}
+
+// signWebhook returns the hex HMAC-SHA256 of timestamp + "." + body, so a
+// receiver can reject replayed deliveries by their timestamp.
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
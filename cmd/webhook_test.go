@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookSignsAndRetries(t *testing.T) {
+	var calls atomic.Int32
+	delivered := make(chan *http.Request, 1)
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body, _ = io.ReadAll(r.Body)
+		delivered <- r
+	}))
+	defer server.Close()
+
+	hooks := newWebhooks(WebhookOption{
+		URLs:    []string{server.URL},
+		Secret:  "secret",
+		Retries: 2,
+	})
+	hooks.Deliver(Event{ID: 1, Type: EventLogout})
+
+	var req *http.Request
+	select {
+	case req = <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not delivered after a retry")
+	}
+
+	timestamp := req.Header.Get("X-Wechat-Timestamp")
+	if unix, err := strconv.ParseInt(timestamp, 10, 64); err != nil ||
+		time.Since(time.Unix(unix, 0)) > time.Minute {
+		t.Errorf("timestamp %q is not the current time", timestamp)
+	}
+	want := "sha256=" + signWebhook("secret", timestamp, body)
+	if got := req.Header.Get("X-Wechat-Signature"); got != want {
+		t.Errorf("signature %q, want %q", got, want)
+	}
+	if signWebhook("secret", "0", body) == signWebhook("secret", timestamp, body) {
+		t.Error("signature does not cover the timestamp")
+	}
+}
+
+func TestWebhookDropsClientErrors(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	hooks := newWebhooks(WebhookOption{URLs: []string{server.URL}, Retries: 3})
+	hooks.Deliver(Event{ID: 1, Type: EventLogout})
+
+	time.Sleep(1500 * time.Millisecond)
+	if n := calls.Load(); n != 1 {
+		t.Errorf("webhook called %d times, want 1", n)
+	}
+}
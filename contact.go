@@ -35,7 +35,7 @@ func (core *Core) GetContact() error {
 		return err
 	}
 
-	resp, err := core.Client.Do(req)
+	resp, err := core.do(req)
 	if err != nil {
 		return err
 	}
@@ -62,7 +62,7 @@ func (core *Core) GetContact() error {
 	if result.Seq == 0 {
 		var contacts []Contact
 		for _, contact := range result.MemberList {
-			core.ContactMap[contact.UserName] = contact
+			core.putContacts(contact)
 			if strings.HasPrefix(contact.UserName, "@@") &&
 				contact.MemberCount == 0 {
 				contacts = append(contacts, contact)
@@ -121,7 +121,7 @@ func (core *Core) BatchGetContact(contacts []Contact) error {
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
 
-	resp, err := core.Client.Do(req)
+	resp, err := core.do(req)
 	if err != nil {
 		return err
 	}
@@ -147,9 +147,114 @@ func (core *Core) BatchGetContact(contacts []Contact) error {
 		return errors.New(errMsg)
 	}
 
-	for _, contact := range result.ContactList {
-		core.ContactMap[contact.UserName] = contact
-	}
+	core.putContacts(result.ContactList...)
 
 	return nil
 }
+
+// Contact returns the contact with userName.
+func (core *Core) Contact(userName string) (Contact, bool) {
+	core.contactMu.RLock()
+	defer core.contactMu.RUnlock()
+
+	contact, ok := core.contactMap[userName]
+	return contact, ok
+}
+
+// Contacts returns a snapshot of all contacts in no particular order.
+func (core *Core) Contacts() []Contact {
+	core.contactMu.RLock()
+	defer core.contactMu.RUnlock()
+
+	contacts := make([]Contact, 0, len(core.contactMap))
+	for _, contact := range core.contactMap {
+		contacts = append(contacts, contact)
+	}
+	return contacts
+}
+
+func (core *Core) ContactCount() int {
+	core.contactMu.RLock()
+	defer core.contactMu.RUnlock()
+
+	return len(core.contactMap)
+}
+
+// setContacts replaces all contacts, when a session is initialized.
+func (core *Core) setContacts(contacts []Contact) {
+	core.contactMu.Lock()
+	defer core.contactMu.Unlock()
+
+	core.contactMap = make(map[string]Contact, len(contacts))
+	for _, contact := range contacts {
+		core.contactMap[contact.UserName] = contact
+	}
+}
+
+func (core *Core) putContacts(contacts ...Contact) {
+	core.contactMu.Lock()
+	defer core.contactMu.Unlock()
+
+	if core.contactMap == nil {
+		core.contactMap = make(map[string]Contact)
+	}
+	for _, contact := range contacts {
+		core.contactMap[contact.UserName] = contact
+	}
+}
+
+func (core *Core) deleteContact(userName string) {
+	core.contactMu.Lock()
+	defer core.contactMu.Unlock()
+
+	delete(core.contactMap, userName)
+}
+
+func IsGroup(userName string) bool {
+	return strings.HasPrefix(userName, "@@")
+}
+
+// DisplayName returns the remark or nickname of a contact, or userName
+// itself when the contact is unknown.
+func (core *Core) DisplayName(userName string) string {
+	if userName == core.User.UserName {
+		return core.User.NickName
+	}
+
+	contact, ok := core.Contact(userName)
+	if !ok {
+		return userName
+	}
+	if len(contact.RemarkName) > 0 {
+		return contact.RemarkName
+	}
+	if len(contact.NickName) > 0 {
+		return contact.NickName
+	}
+	return userName
+}
+
+// MemberDisplayName returns the name a group member is shown with inside
+// the group, falling back to DisplayName.
+func (core *Core) MemberDisplayName(group string, member string) string {
+	groupContact, _ := core.Contact(group)
+	for _, contact := range groupContact.MemberList {
+		if contact.UserName != member {
+			continue
+		}
+		if len(contact.DisplayName) > 0 {
+			return contact.DisplayName
+		}
+		if _, ok := core.Contact(member); !ok &&
+			len(contact.NickName) > 0 {
+			return contact.NickName
+		}
+		break
+	}
+	return core.DisplayName(member)
+}
+
+// IsOfficial reports whether contact is an official or service account.
+func (contact Contact) IsOfficial() bool {
+	return contact.VerifyFlag&8 != 0
+}
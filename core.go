@@ -2,24 +2,43 @@ package wechat
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"math/rand"
+	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/binarycraft007/wechat/utils"
 	"github.com/skip2/go-qrcode"
 
 	"net/http"
-	"net/http/cookiejar"
 	"net/url"
 )
 
+type LoginState = int
+
+const (
+	LoginIdle      LoginState = 0 // no login started yet
+	LoginWaiting   LoginState = 1 // qrcode shown, not scanned yet
+	LoginScanned   LoginState = 2 // scanned, waiting for confirmation
+	LoginConfirmed LoginState = 3 // confirmed on the phone
+	LoginExpired   LoginState = 4 // qrcode expired, a new uuid is needed
+	LoggedIn       LoginState = 5
+	LoggedOut      LoginState = 6
+)
+
+type LoginStateFunc = func(state LoginState)
+
+var reLoginCode = regexp.MustCompile(`window.code=(\d+);`)
+
 type SessionData struct {
 	UUID       string
 	Skey       string
@@ -27,46 +46,105 @@ type SessionData struct {
 	Uin        string
 	PassTicket string
 	DataTicket string
+	DeviceID   string // generated once per login, sent with every request
 }
 
 type Core struct {
 	Config          utils.Config
 	SessionData     SessionData
-	User            User
-	Avatar          string
+	User            User   // written under statusMu, read through Status
+	Avatar          string // written under statusMu, read through Status
 	RedirectUri     string
-	QrCodeUrl       string
+	QrCodeUrl       string // written under statusMu, read through Status
 	QrCode          string
+	QrCodeContent   string     // written under statusMu, read through Status
+	loginState      LoginState // guarded by statusMu
+	loginSince      time.Time  // guarded by statusMu
+	LoginStateFunc  LoginStateFunc
 	NotifyUserName  string
-	ContactMap      map[string]Contact
+	contactMap      map[string]Contact // guarded by contactMu, use the accessors
 	LastSyncTime    int64
-	SyncKey         SyncKey
+	SyncKey         SyncKey // sent to webwxsync
+	SyncCheckKey    SyncKey // formated into synccheck requests
 	SyncSelector    SyncType
 	FormatedSyncKey string
 	ContactSeq      int
 	Client          *http.Client
 	SyncMsgFunc     SyncFunc
 	SyncContactFunc SyncFunc
+	Outbox          *Outbox
+	History         *History
+	SessionFile     string
+	Metrics         Metrics
+	Logger          Logger
+	RedactLogs      bool          // hide message content, tickets and keys
+	Images          *ImageOptions // nil uploads images unchanged
+	initTime        time.Time     // guarded by statusMu
+	seen            *seenCache
+	rand            *rand.Rand
+	msgSeq          atomic.Uint32
+	contactMu       sync.RWMutex
+	statusMu        sync.Mutex
+	syncErrors      int
+	lastSyncError   error
 }
 
 type CoreOption struct {
 	SyncMsgFunc     SyncFunc
 	SyncContactFunc SyncFunc
+	LoginStateFunc  LoginStateFunc
+	Outbox          *Outbox
+	History         *History
+	SessionFile     string // optional, where the session is persisted
+	SeenMsgCapacity int    // size of the message dedup cache
+	Metrics         Metrics
+	Logger          Logger // slog.Default() when nil
+	RedactLogs      bool
+	Rand            *rand.Rand    // source of device ids, seeded with the time when nil
+	Images          *ImageOptions // nil uploads images unchanged
+
+	// Client is copied and its transport wrapped, Transport replaces the
+	// transport of Client. ProxyURL only applies to the default transport.
+	Client       *http.Client
+	Transport    http.RoundTripper
+	ProxyURL     string
+	Jar          http.CookieJar
+	Timeouts     Timeouts
+	UserAgent    string // DefaultUserAgent when empty
+	RequestHook  RequestHook
+	ResponseHook ResponseHook
 }
 
 func New(options CoreOption) (*Core, error) {
-	jar, err := cookiejar.New(nil)
+	core := Core{
+		SyncMsgFunc:     options.SyncMsgFunc,
+		SyncContactFunc: options.SyncContactFunc,
+		LoginStateFunc:  options.LoginStateFunc,
+		Outbox:          options.Outbox,
+		History:         options.History,
+		SessionFile:     options.SessionFile,
+		Metrics:         options.Metrics,
+		Logger:          options.Logger,
+		RedactLogs:      options.RedactLogs,
+		seen:            newSeenCache(options.SeenMsgCapacity),
+		rand:            options.Rand,
+		Images:          options.Images,
+		loginSince:      time.Now(),
+	}
+
+	if core.rand == nil {
+		core.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	core.SessionData.DeviceID = utils.GetDeviceID(core.rand)
+
+	client, err := core.newClient(options)
 	if err != nil {
 		return nil, err
 	}
+	core.Client = client
 
-	core := Core{
-		SyncMsgFunc:     options.SyncMsgFunc,
-		SyncContactFunc: options.SyncContactFunc,
-		Client: &http.Client{
-			CheckRedirect: nil,
-			Jar:           jar,
-		},
+	if core.Logger == nil {
+		core.Logger = defaultLogger()
 	}
 
 	config, err := utils.NewConfig(utils.ConfigOption{})
@@ -75,11 +153,24 @@ func New(options CoreOption) (*Core, error) {
 	}
 
 	core.Config = *config
+
+	if len(core.SessionFile) > 0 {
+		_, err := core.LoadSession(core.SessionFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
 	return &core, nil
 }
 
 func (core *Core) GetUUID() error {
-	resp, err := core.Client.Post(core.Config.Api.JsLogin, "", http.NoBody)
+	req, err := http.NewRequest("POST", core.Config.Api.JsLogin, http.NoBody)
+	if err != nil {
+		return err
+	}
+
+	resp, err := core.do(req)
 	if err != nil {
 		return err
 	}
@@ -101,7 +192,6 @@ func (core *Core) GetUUID() error {
 		return errors.New(errMsg)
 	}
 
-	core.QrCodeUrl = "https://login.weixin.qq.com/qrcode/" + uuid
 	qrCodeContent := "https://login.weixin.qq.com/l/" + uuid
 
 	qrCode, err := qrcode.New(qrCodeContent, qrcode.Medium)
@@ -109,11 +199,39 @@ func (core *Core) GetUUID() error {
 		return err
 	}
 
+	core.statusMu.Lock()
+	core.QrCodeUrl = "https://login.weixin.qq.com/qrcode/" + uuid
 	core.QrCode = qrCode.ToSmallString(false)
+	core.QrCodeContent = qrCodeContent
+	core.Avatar = ""
+	core.statusMu.Unlock()
 	core.SessionData.UUID = uuid
+	core.SessionData.DeviceID = utils.GetDeviceID(core.rand)
+	core.setLoginState(LoginWaiting)
 	return nil
 }
 
+// LoginState returns where the current login stands.
+func (core *Core) LoginState() LoginState {
+	core.statusMu.Lock()
+	defer core.statusMu.Unlock()
+
+	return core.loginState
+}
+
+func (core *Core) setLoginState(state LoginState) {
+	core.statusMu.Lock()
+	if (state == LoggedIn) != (core.loginState == LoggedIn) {
+		core.loginSince = time.Now()
+	}
+	core.loginState = state
+	core.statusMu.Unlock()
+
+	if core.LoginStateFunc != nil {
+		core.LoginStateFunc(state)
+	}
+}
+
 func (core *Core) PreLogin() error {
 	ts := ^time.Now().UnixNano()
 
@@ -129,7 +247,12 @@ func (core *Core) PreLogin() error {
 	}
 	u.RawQuery = params.Encode()
 
-	resp, err := core.Client.Get(u.String())
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := core.do(req)
 	if err != nil {
 		return err
 	}
@@ -144,6 +267,15 @@ func (core *Core) PreLogin() error {
 	httpStatusCreated := strings.Contains(string(body), "window.userAvatar")
 
 	if !httpStatusCreated && !httpStatusSuccess {
+		code := reLoginCode.FindStringSubmatch(string(body))
+		if len(code) > 1 && code[1] == "408" {
+			return ErrLoginTimeout
+		}
+		if len(code) > 1 && code[1] == "400" {
+			core.setLoginState(LoginExpired)
+			return ErrQrCodeExpired
+		}
+
 		start := strings.Index(string(body), "window.code=")
 		start += len("window.code=") + 1
 		end := len(string(body)) - 2
@@ -172,6 +304,7 @@ func (core *Core) PreLogin() error {
 
 		core.Config = *config
 		core.RedirectUri = redirectUri
+		core.setLoginState(LoginConfirmed)
 	}
 
 	if httpStatusCreated {
@@ -179,7 +312,10 @@ func (core *Core) PreLogin() error {
 		start += len("userAvatar = ") + 1
 		end := len(string(body)) - 2
 
+		core.statusMu.Lock()
 		core.Avatar = string(body)[start:end]
+		core.statusMu.Unlock()
+		core.setLoginState(LoginScanned)
 
 		if err := core.PreLogin(); err != nil {
 			return err
@@ -190,23 +326,18 @@ func (core *Core) PreLogin() error {
 }
 
 func (core *Core) Login() error {
-	core.Client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-		return http.ErrUseLastResponse
-	}
-
-	req, err := http.NewRequest("GET", core.RedirectUri, nil)
+	req, err := http.NewRequestWithContext(
+		withoutRedirects(context.Background()), "GET", core.RedirectUri, nil)
 	if err != nil {
 		return err
 	}
-	req.Header.Add("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/113.0.0.0 Safari/537.36")
 	req.Header.Add("client-version", "2.0.0")
 	req.Header.Add("referer", "https://wx.qq.com/?&lang=zh_CN&target=t")
 	req.Header.Add("extspam", "Go8FCIkFEokFCggwMDAwMDAwMRAGGvAESySibk50w5Wb3uTl2c2h64jVVrV7gNs06GFlWplHQbY/5FfiO++1yH4ykCyNPWKXmco+wfQzK5R98D3so7rJ5LmGFvBLjGceleySrc3SOf2Pc1gVehzJgODeS0lDL3/I/0S2SSE98YgKleq6Uqx6ndTy9yaL9qFxJL7eiA/R3SEfTaW1SBoSITIu+EEkXff+Pv8NHOk7N57rcGk1w0ZzRrQDkXTOXFN2iHYIzAAZPIOY45Lsh+A4slpgnDiaOvRtlQYCt97nmPLuTipOJ8Qc5pM7ZsOsAPPrCQL7nK0I7aPrFDF0q4ziUUKettzW8MrAaiVfmbD1/VkmLNVqqZVvBCtRblXb5FHmtS8FxnqCzYP4WFvz3T0TcrOqwLX1M/DQvcHaGGw0B0y4bZMs7lVScGBFxMj3vbFi2SRKbKhaitxHfYHAOAa0X7/MSS0RNAjdwoyGHeOepXOKY+h3iHeqCvgOH6LOifdHf/1aaZNwSkGotYnYScW8Yx63LnSwba7+hESrtPa/huRmB9KWvMCKbDThL/nne14hnL277EDCSocPu3rOSYjuB9gKSOdVmWsj9Dxb/iZIe+S6AiG29Esm+/eUacSba0k8wn5HhHg9d4tIcixrxveflc8vi2/wNQGVFNsGO6tB5WF0xf/plngOvQ1/ivGV/C1Qpdhzznh0ExAVJ6dwzNg7qIEBaw+BzTJTUuRcPk92Sn6QDn2Pu3mpONaEumacjW4w6ipPnPw+g2TfywJjeEcpSZaP4Q3YV5HG8D6UjWA4GSkBKculWpdCMadx0usMomsSS/74QgpYqcPkmamB4nVv1JxczYITIqItIKjD35IGKAUwAA==")
-	resp, err := core.Client.Do(req)
+	resp, err := core.do(req)
 	if err != nil {
 		return err
 	}
-	core.Client.CheckRedirect = nil
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusMovedPermanently {
@@ -306,7 +437,7 @@ func (core *Core) Init() error {
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
 
-	resp, err := core.Client.Do(req)
+	resp, err := core.do(req)
 	if err != nil {
 		return err
 	}
@@ -332,8 +463,7 @@ func (core *Core) Init() error {
 	}
 
 	if result.BaseResponse.Ret != 0 {
-		errMsg := utils.GetErrorMsgInt(result.BaseResponse.Ret)
-		return errors.New(errMsg)
+		return &RetError{Ret: result.BaseResponse.Ret}
 	}
 
 	if len(result.SKey) > 0 {
@@ -341,16 +471,26 @@ func (core *Core) Init() error {
 	}
 
 	core.SyncKey = result.SyncKey
+	core.SyncCheckKey = result.SyncKey
 	core.SetFormatedSyncKey(result.SyncKey)
 
+	core.statusMu.Lock()
 	core.User = result.User
-	core.ContactMap = make(map[string]Contact)
-
-	for _, contact := range result.ContactList {
-		core.ContactMap[contact.UserName] = contact
-	}
-
-	log.Println("logged in:", core.User.NickName)
+	core.statusMu.Unlock()
+	core.setContacts(result.ContactList)
+
+	core.Logger.Info("logged in", "user", core.User.NickName)
+	core.Logger.Debug("session initialized",
+		"uin", core.secret(core.SessionData.Uin),
+		"skey", core.secret(core.SessionData.Skey),
+		"pass_ticket", core.secret(core.SessionData.PassTicket),
+		"contacts", core.ContactCount())
+	core.statusMu.Lock()
+	core.initTime = time.Now()
+	core.statusMu.Unlock()
+	core.recordSyncResult(nil)
+	core.setLoginState(LoggedIn)
+	core.saveSession()
 
 	return nil
 }
@@ -365,7 +505,7 @@ func (core *Core) GetBaseRequest() (*BaseRequest, error) {
 		Uin:      uin,
 		Sid:      core.SessionData.Sid,
 		Skey:     core.SessionData.Skey,
-		DeviceID: utils.GetDeviceID(),
+		DeviceID: core.SessionData.DeviceID,
 	}, nil
 }
 
@@ -390,12 +530,18 @@ func (core *Core) Logout() error {
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
 
-	resp, err := core.Client.Do(req)
+	resp, err := core.do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
+	core.setLoginState(LoggedOut)
+
+	// The session is gone for good, nothing to resume after a restart
+	core.SessionData = SessionData{}
+	core.saveSession()
+
 	if resp.StatusCode != http.StatusOK {
 		errMsg := utils.GetErrorMsgInt(resp.StatusCode)
 		return errors.New(errMsg)
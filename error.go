@@ -1,9 +1,30 @@
 package wechat
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var ErrAlreadyLoggedOut = errors.New("already logged out")
 var ErrUnknownFileType = errors.New("unknown file type")
 var ErrContactListEmpty = errors.New("contact list empty")
 var ErrInvalidMsgType = errors.New("invalid message type")
 var ErrFailedToGetExt = errors.New("failed to get extension")
+var ErrLoginTimeout = errors.New("login timeout, qrcode not scanned yet")
+var ErrQrCodeExpired = errors.New("qrcode expired")
+var ErrInvalidMP4 = errors.New("invalid mp4 container")
+var ErrNoSession = errors.New("no session to resume")
+var ErrRecipientNotFound = errors.New("recipient not found")
+var ErrRecipientAmbiguous = errors.New("recipient matches several contacts")
+var ErrProxyWithTransport = errors.New("proxy url set together with a transport")
+var ErrImageTooLarge = errors.New("image has too many pixels to decode")
+var ErrQueued = errors.New("queued in the outbox until the next login")
+
+// RetError is returned when the server answers with a non-zero Ret.
+type RetError struct {
+	Ret int
+}
+
+func (err *RetError) Error() string {
+	return fmt.Sprintf("ret %d", err.Ret)
+}
@@ -0,0 +1,300 @@
+package export
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/binarycraft007/wechat"
+)
+
+type Options struct {
+	Title string
+	// Core is used to download images and to resolve names the records
+	// were stored without. Both are skipped when it is nil.
+	Core *wechat.Core
+	// Location of the timestamps, time.Local when nil.
+	Location *time.Location
+	// ImageMissed is called for every image HTML could not inline, the
+	// server may no longer have the images of old messages.
+	ImageMissed func(entry Entry, err error)
+}
+
+type Entry struct {
+	MsgID      string    `json:"MsgId"`
+	Time       time.Time `json:"Time"`
+	ChatName   string    `json:"ChatName"`
+	SenderName string    `json:"SenderName"`
+	Outgoing   bool      `json:"Outgoing"`
+	MsgType    int       `json:"MsgType"`
+	Text       string    `json:"Text"`
+	FileName   string    `json:"FileName,omitempty"`
+}
+
+type Chat struct {
+	Name    string
+	Entries []Entry
+}
+
+// Chats groups records by chat, keeping the order in which each chat
+// first appears.
+func Chats(records []wechat.HistoryRecord, options Options) []Chat {
+	var chats []Chat
+	index := make(map[string]int)
+
+	for _, record := range records {
+		i, ok := index[record.ChatUserName]
+		if !ok {
+			i = len(chats)
+			index[record.ChatUserName] = i
+			chats = append(chats, Chat{Name: chatName(record, options)})
+		}
+		chats[i].Entries = append(chats[i].Entries, NewEntry(record, options))
+	}
+
+	for _, chat := range chats {
+		sort.SliceStable(chat.Entries, func(i, j int) bool {
+			return chat.Entries[i].Time.Before(chat.Entries[j].Time)
+		})
+	}
+
+	return chats
+}
+
+func NewEntry(record wechat.HistoryRecord, options Options) Entry {
+	location := options.Location
+	if location == nil {
+		location = time.Local
+	}
+
+	entry := Entry{
+		MsgID:      record.MsgID,
+		Time:       time.Unix(int64(record.CreateTime), 0).In(location),
+		ChatName:   chatName(record, options),
+		SenderName: record.SenderName,
+		Outgoing:   record.Outgoing,
+		MsgType:    record.MsgType,
+		Text:       record.Text,
+		FileName:   record.FileName,
+	}
+
+	// Older records may lack the fields History resolves, fall back to
+	// the raw message.
+	if len(entry.Text) == 0 && len(record.Content) > 0 {
+		sender, text := wechat.SplitGroupContent(record.Content)
+		entry.Text = text
+		if len(sender) > 0 && len(record.SenderUserName) == 0 {
+			record.SenderUserName = sender
+		}
+	}
+
+	if len(record.SenderUserName) == 0 {
+		record.SenderUserName = record.FromUserName
+	}
+
+	if len(entry.SenderName) == 0 ||
+		entry.SenderName == record.SenderUserName {
+		entry.SenderName = record.SenderUserName
+		if options.Core != nil {
+			if wechat.IsGroup(record.ChatUserName) {
+				entry.SenderName = options.Core.MemberDisplayName(
+					record.ChatUserName, record.SenderUserName)
+			} else {
+				entry.SenderName = options.Core.DisplayName(
+					record.SenderUserName)
+			}
+		}
+	}
+
+	entry.Text = strings.ReplaceAll(entry.Text, "<br/>", "\n")
+	entry.Text = html.UnescapeString(entry.Text)
+
+	return entry
+}
+
+func chatName(record wechat.HistoryRecord, options Options) string {
+	if len(record.ChatName) > 0 && record.ChatName != record.ChatUserName {
+		return record.ChatName
+	}
+	if options.Core != nil {
+		return options.Core.DisplayName(record.ChatUserName)
+	}
+	return record.ChatUserName
+}
+
+// Summary is the text shown for a message in plain text transcripts.
+func (entry Entry) Summary() string {
+	switch wechat.MessageType(entry.MsgType) {
+	case wechat.Text:
+		return entry.Text
+	case wechat.Image:
+		return "[image]"
+	case wechat.Voice:
+		return "[voice]"
+	case wechat.Video, wechat.MicroVideo:
+		return "[video]"
+	case wechat.Emoticon:
+		return "[emoticon]"
+	case wechat.Location:
+		return "[location] " + entry.Text
+	case wechat.ShareCard:
+		return "[card]"
+	case wechat.Attach, wechat.App:
+		if len(entry.FileName) > 0 {
+			return "[file] " + entry.FileName
+		}
+		return "[app message]"
+	case wechat.Recalled:
+		return "[recalled]"
+	}
+	return entry.Text
+}
+
+func JSONLines(w io.Writer, records []wechat.HistoryRecord, options Options) error {
+	writer := bufio.NewWriter(w)
+	encoder := json.NewEncoder(writer)
+	encoder.SetEscapeHTML(false)
+
+	for _, chat := range Chats(records, options) {
+		for _, entry := range chat.Entries {
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+	}
+
+	return writer.Flush()
+}
+
+func Text(w io.Writer, records []wechat.HistoryRecord, options Options) error {
+	writer := bufio.NewWriter(w)
+
+	if len(options.Title) > 0 {
+		fmt.Fprintf(writer, "%s\n\n", options.Title)
+	}
+
+	for i, chat := range Chats(records, options) {
+		if i > 0 {
+			fmt.Fprintln(writer)
+		}
+		fmt.Fprintf(writer, "== %s ==\n", chat.Name)
+
+		for _, entry := range chat.Entries {
+			text := strings.ReplaceAll(entry.Summary(), "\n", "\n    ")
+			fmt.Fprintf(writer, "[%s] %s: %s\n",
+				entry.Time.Format("2006-01-02 15:04:05"),
+				entry.SenderName, text)
+		}
+	}
+
+	return writer.Flush()
+}
+
+type htmlEntry struct {
+	Entry
+	Summary string
+	Image   template.URL
+	Missing bool // an image that could not be downloaded
+}
+
+type htmlChat struct {
+	Name    string
+	Entries []htmlEntry
+}
+
+var htmlTemplate = template.Must(template.New("transcript").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; background: #f5f5f5; margin: 2em; }
+h2 { border-bottom: 1px solid #ccc; }
+.msg { margin: .5em 0; max-width: 40em; padding: .5em .8em; border-radius: 4px; background: #fff; }
+.out { margin-left: auto; background: #9eea6a; }
+.meta { color: #888; font-size: .8em; }
+.text { white-space: pre-wrap; }
+.missing { color: #888; font-style: italic; }
+img { max-width: 100%; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{range .Chats}}<h2>{{.Name}}</h2>
+{{range .Entries}}<div class="msg{{if .Outgoing}} out{{end}}">
+<div class="meta">{{.SenderName}} &middot; {{.Time.Format "2006-01-02 15:04:05"}}</div>
+{{if .Image}}<img src="{{.Image}}" alt="image">{{else if .Missing}}<div class="missing">[image unavailable]</div>{{else}}<div class="text">{{.Summary}}</div>{{end}}
+</div>
+{{end}}{{end}}</body>
+</html>
+`))
+
+// HTML writes a self-contained transcript. Images are downloaded through
+// options.Core and inlined as data URLs, those that fail are shown as a
+// placeholder and passed to options.ImageMissed.
+func HTML(w io.Writer, records []wechat.HistoryRecord, options Options) error {
+	title := options.Title
+	if len(title) == 0 {
+		title = "Chat history"
+	}
+
+	var chats []htmlChat
+	for _, chat := range Chats(records, options) {
+		htmlChat := htmlChat{Name: chat.Name}
+		for _, entry := range chat.Entries {
+			image, err := inlineImage(entry, options)
+			if err != nil && options.ImageMissed != nil {
+				options.ImageMissed(entry, err)
+			}
+			htmlChat.Entries = append(htmlChat.Entries, htmlEntry{
+				Entry:   entry,
+				Summary: entry.Summary(),
+				Image:   image,
+				Missing: err != nil,
+			})
+		}
+		chats = append(chats, htmlChat)
+	}
+
+	return htmlTemplate.Execute(w, struct {
+		Title string
+		Chats []htmlChat
+	}{title, chats})
+}
+
+// inlineImage returns an empty url without error for entries that are
+// not images or when there is no Core to download them.
+func inlineImage(entry Entry, options Options) (template.URL, error) {
+	if options.Core == nil ||
+		wechat.MessageType(entry.MsgType) != wechat.Image {
+		return "", nil
+	}
+	if len(entry.MsgID) == 0 {
+		return "", errors.New("no message id")
+	}
+
+	data, err := options.Core.GetMsgImg(entry.MsgID)
+	if err != nil {
+		return "", err
+	}
+	if len(data) == 0 {
+		return "", errors.New("empty image")
+	}
+
+	contentType := http.DetectContentType(data)
+	if !strings.HasPrefix(contentType, "image/") {
+		return "", fmt.Errorf("not an image: %s", contentType)
+	}
+
+	return template.URL("data:" + contentType + ";base64," +
+		base64.StdEncoding.EncodeToString(data)), nil
+}
@@ -0,0 +1,148 @@
+package export
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/binarycraft007/wechat"
+)
+
+func record(chat string, from string, createTime int, msgType wechat.MessageType, content string) wechat.HistoryRecord {
+	return wechat.HistoryRecord{
+		Message: wechat.Message{
+			MsgID:        "id-" + content,
+			FromUserName: from,
+			MsgType:      int(msgType),
+			Content:      content,
+			CreateTime:   createTime,
+		},
+		ChatUserName: chat,
+	}
+}
+
+func TestNewEntry(t *testing.T) {
+	tests := []struct {
+		name       string
+		record     wechat.HistoryRecord
+		text       string
+		senderName string
+		chatName   string
+	}{
+		{"plain", record("@alice", "@alice", 0, wechat.Text, "hi"),
+			"hi", "@alice", "@alice"},
+		{"group content", record("@@group", "@@group", 0, wechat.Text,
+			"@bob:<br/>hello"), "hello", "@bob", "@@group"},
+		{"markup", record("@alice", "@alice", 0, wechat.Text,
+			"a &amp; b<br/>c"), "a & b\nc", "@alice", "@alice"},
+		{"resolved", wechat.HistoryRecord{
+			Message:      wechat.Message{FromUserName: "@alice", Content: "raw"},
+			ChatUserName: "@alice", ChatName: "Alice",
+			SenderUserName: "@alice", SenderName: "Alice", Text: "hi",
+		}, "hi", "Alice", "Alice"},
+	}
+
+	for _, test := range tests {
+		entry := NewEntry(test.record, Options{Location: time.UTC})
+		if entry.Text != test.text || entry.SenderName != test.senderName ||
+			entry.ChatName != test.chatName {
+			t.Errorf("%s: entry %q from %q in %q, want %q from %q in %q",
+				test.name, entry.Text, entry.SenderName, entry.ChatName,
+				test.text, test.senderName, test.chatName)
+		}
+	}
+}
+
+func TestSummary(t *testing.T) {
+	tests := []struct {
+		entry Entry
+		want  string
+	}{
+		{Entry{MsgType: int(wechat.Text), Text: "hi"}, "hi"},
+		{Entry{MsgType: int(wechat.Image)}, "[image]"},
+		{Entry{MsgType: int(wechat.MicroVideo)}, "[video]"},
+		{Entry{MsgType: int(wechat.Location), Text: "Berlin"}, "[location] Berlin"},
+		{Entry{MsgType: int(wechat.Attach), FileName: "a.pdf"}, "[file] a.pdf"},
+		{Entry{MsgType: int(wechat.App)}, "[app message]"},
+		{Entry{MsgType: int(wechat.Recalled)}, "[recalled]"},
+		{Entry{MsgType: int(wechat.System), Text: "joined"}, "joined"},
+	}
+
+	for _, test := range tests {
+		if got := test.entry.Summary(); got != test.want {
+			t.Errorf("type %d: Summary = %q, want %q",
+				test.entry.MsgType, got, test.want)
+		}
+	}
+}
+
+func TestText(t *testing.T) {
+	records := []wechat.HistoryRecord{
+		record("@alice", "@alice", 120, wechat.Text, "second"),
+		record("@bob", "@bob", 60, wechat.Image, "img"),
+		record("@alice", "@alice", 0, wechat.Text, "first<br/>line"),
+	}
+
+	var buf bytes.Buffer
+	if err := Text(&buf, records, Options{Title: "T", Location: time.UTC}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "T\n\n" +
+		"== @alice ==\n" +
+		"[1970-01-01 00:00:00] @alice: first\n    line\n" +
+		"[1970-01-01 00:02:00] @alice: second\n" +
+		"\n== @bob ==\n" +
+		"[1970-01-01 00:01:00] @bob: [image]\n"
+	if buf.String() != want {
+		t.Errorf("transcript\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (fn roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return fn(req)
+}
+
+func TestHTMLMissingImage(t *testing.T) {
+	core, err := wechat.New(wechat.CoreOption{
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			return nil, errors.New("gone")
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var missed []string
+	options := Options{
+		Core:     core,
+		Location: time.UTC,
+		ImageMissed: func(entry Entry, err error) {
+			missed = append(missed, entry.MsgID)
+		},
+	}
+
+	var buf bytes.Buffer
+	records := []wechat.HistoryRecord{
+		record("@alice", "@alice", 0, wechat.Image, "old"),
+		record("@alice", "@alice", 1, wechat.Text, "<b>hi</b>"),
+	}
+	if err := HTML(&buf, records, options); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(missed) != 1 || missed[0] != "id-old" {
+		t.Errorf("missed %v, want [id-old]", missed)
+	}
+	if !strings.Contains(buf.String(), "[image unavailable]") {
+		t.Error("no placeholder for the missing image")
+	}
+	if strings.Contains(buf.String(), "<b>hi</b>") {
+		t.Error("text is not escaped")
+	}
+}
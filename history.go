@@ -0,0 +1,231 @@
+package wechat
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type HistoryRecord struct {
+	Message
+	Outgoing       bool   `json:"Outgoing"`
+	ChatUserName   string `json:"ChatUserName"`
+	ChatName       string `json:"ChatName"`
+	SenderUserName string `json:"SenderUserName"`
+	SenderName     string `json:"SenderName"`
+	Text           string `json:"Text"`
+}
+
+// HistoryQuery selects records of a History. UserNames change with every
+// login, so Chat and Sender should be display names to match the records
+// of earlier sessions, a UserName only matches the current one.
+type HistoryQuery struct {
+	Chat    string // display name or UserName of the chat
+	Sender  string // display name or UserName of the sender
+	Since   time.Time
+	Until   time.Time
+	MsgType MessageType
+	Keyword string
+	Limit   int
+}
+
+// History keeps every message seen by a Core in a JSON lines file and an
+// in-memory index that is rebuilt from the file when it is opened.
+type History struct {
+	mu      sync.RWMutex
+	file    *os.File
+	records []HistoryRecord
+	corrupt int
+}
+
+func NewHistory(path string) (*History, error) {
+	history := History{}
+
+	file, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var record HistoryRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				history.corrupt++
+				continue
+			}
+			history.records = append(history.records, record)
+		}
+		file.Close()
+
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	history.file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &history, nil
+}
+
+// Corrupt returns how many lines of the file could not be parsed when it
+// was opened, those records are left out of Search.
+func (history *History) Corrupt() int {
+	return history.corrupt
+}
+
+func (history *History) Record(records ...HistoryRecord) error {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	var buf []byte
+	for _, record := range records {
+		marshalled, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, marshalled...)
+		buf = append(buf, '\n')
+	}
+
+	if _, err := history.file.Write(buf); err != nil {
+		return err
+	}
+
+	history.records = append(history.records, records...)
+	return nil
+}
+
+// Search returns the records matching every non-zero field of query,
+// oldest first. With a Limit only the newest Limit matches are returned.
+func (history *History) Search(query HistoryQuery) []HistoryRecord {
+	history.mu.RLock()
+	defer history.mu.RUnlock()
+
+	keywords := strings.Fields(strings.ToLower(query.Keyword))
+
+	var result []HistoryRecord
+	for _, record := range history.records {
+		if len(query.Chat) > 0 &&
+			record.ChatUserName != query.Chat &&
+			!strings.EqualFold(record.ChatName, query.Chat) {
+			continue
+		}
+
+		if len(query.Sender) > 0 &&
+			record.SenderUserName != query.Sender &&
+			!strings.EqualFold(record.SenderName, query.Sender) {
+			continue
+		}
+
+		createTime := time.Unix(int64(record.CreateTime), 0)
+		if !query.Since.IsZero() && createTime.Before(query.Since) {
+			continue
+		}
+		if !query.Until.IsZero() && !createTime.Before(query.Until) {
+			continue
+		}
+
+		if query.MsgType != 0 && MessageType(record.MsgType) != query.MsgType {
+			continue
+		}
+
+		if !containsAll(strings.ToLower(record.Text), keywords) {
+			continue
+		}
+
+		result = append(result, record)
+	}
+
+	if query.Limit > 0 && len(result) > query.Limit {
+		result = result[len(result)-query.Limit:]
+	}
+
+	return result
+}
+
+// Chats returns the UserNames of all chats in the history.
+func (history *History) Chats() []string {
+	history.mu.RLock()
+	defer history.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var chats []string
+	for _, record := range history.records {
+		if !seen[record.ChatUserName] {
+			seen[record.ChatUserName] = true
+			chats = append(chats, record.ChatUserName)
+		}
+	}
+	return chats
+}
+
+func (history *History) Close() error {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+
+	return history.file.Close()
+}
+
+func containsAll(text string, keywords []string) bool {
+	for _, keyword := range keywords {
+		if !strings.Contains(text, keyword) {
+			return false
+		}
+	}
+	return true
+}
+
+// NewHistoryRecord resolves chat and sender names of msg from the contacts
+// currently known to core.
+func (core *Core) NewHistoryRecord(msg Message) HistoryRecord {
+	record := HistoryRecord{
+		Message:        msg,
+		Outgoing:       msg.FromUserName == core.User.UserName,
+		SenderUserName: msg.FromUserName,
+		Text:           msg.Content,
+	}
+
+	if record.Outgoing {
+		record.ChatUserName = msg.ToUserName
+	} else {
+		record.ChatUserName = msg.FromUserName
+	}
+	record.ChatName = core.DisplayName(record.ChatUserName)
+
+	if IsGroup(record.ChatUserName) && !record.Outgoing {
+		sender, text := SplitGroupContent(msg.Content)
+		if len(sender) > 0 {
+			record.SenderUserName = sender
+			record.Text = text
+		}
+		record.SenderName = core.MemberDisplayName(
+			record.ChatUserName, record.SenderUserName)
+	} else {
+		record.SenderName = core.DisplayName(record.SenderUserName)
+	}
+
+	return record
+}
+
+func (core *Core) recordHistory(messages ...Message) {
+	if core.History == nil || len(messages) == 0 {
+		return
+	}
+
+	records := make([]HistoryRecord, len(messages))
+	for i, msg := range messages {
+		records[i] = core.NewHistoryRecord(msg)
+	}
+
+	if err := core.History.Record(records...); err != nil {
+		core.Logger.Error("record history failed", "err", err)
+	}
+}
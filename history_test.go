@@ -0,0 +1,104 @@
+package wechat
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func historyRecord(id string, at int, chat, chatName, sender, senderName string,
+	msgType MessageType, text string) HistoryRecord {
+	return HistoryRecord{
+		Message: Message{
+			MsgID:      id,
+			MsgType:    int(msgType),
+			CreateTime: at,
+		},
+		ChatUserName:   chat,
+		ChatName:       chatName,
+		SenderUserName: sender,
+		SenderName:     senderName,
+		Text:           text,
+	}
+}
+
+func TestHistorySearch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	history, err := NewHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer history.Close()
+
+	if err := history.Record(
+		historyRecord("1", 100, "@@ops", "Ops", "@alice", "Alice", Text, "Deploy failed on web"),
+		historyRecord("2", 200, "@@ops", "Ops", "@bob", "Bob", Text, "deploy done"),
+		historyRecord("3", 300, "@carol", "Carol", "@carol", "Carol", Image, ""),
+		historyRecord("4", 400, "@@ops", "Ops", "@alice", "Alice", Text, "web deploy done"),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		query HistoryQuery
+		want  string
+	}{
+		{"all", HistoryQuery{}, "1,2,3,4"},
+		{"chat by username", HistoryQuery{Chat: "@@ops"}, "1,2,4"},
+		{"chat by name", HistoryQuery{Chat: "ops"}, "1,2,4"},
+		{"sender by username", HistoryQuery{Sender: "@alice"}, "1,4"},
+		{"sender by name", HistoryQuery{Sender: "Bob"}, "2"},
+		{"since", HistoryQuery{Since: time.Unix(200, 0)}, "2,3,4"},
+		{"until is exclusive", HistoryQuery{Until: time.Unix(300, 0)}, "1,2"},
+		{"msg type", HistoryQuery{MsgType: Image}, "3"},
+		{"keywords", HistoryQuery{Keyword: "DEPLOY web"}, "1,4"},
+		{"limit keeps newest", HistoryQuery{Chat: "Ops", Limit: 2}, "2,4"},
+		{"no match", HistoryQuery{Chat: "Ops", Sender: "Carol"}, ""},
+	}
+
+	for _, test := range tests {
+		var ids []string
+		for _, record := range history.Search(test.query) {
+			ids = append(ids, record.MsgID)
+		}
+		if got := strings.Join(ids, ","); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNewHistoryCountsCorruptLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	history, err := NewHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := history.Record(historyRecord("1", 100, "@carol", "Carol",
+		"@carol", "Carol", Text, "hi")); err != nil {
+		t.Fatal(err)
+	}
+	history.Close()
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("{\"MsgID\":\n")
+	file.Close()
+
+	history, err = NewHistory(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer history.Close()
+
+	if history.Corrupt() != 1 {
+		t.Errorf("corrupt lines %d, want 1", history.Corrupt())
+	}
+	if records := history.Search(HistoryQuery{}); len(records) != 1 {
+		t.Errorf("reopened history has %d records, want 1", len(records))
+	}
+}
@@ -0,0 +1,333 @@
+package wechat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/draw"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+type ImageFormat string
+
+const (
+	ImageJPEG ImageFormat = "jpeg"
+	ImagePNG  ImageFormat = "png"
+	ImageGIF  ImageFormat = "gif"
+)
+
+const DefaultImageQuality = 85
+
+// DefaultMaxImagePixels bounds the memory a decoded image takes, a small
+// file may declare a huge canvas.
+const DefaultMaxImagePixels = 50 * 1000 * 1000
+
+// minImageQuality is as far as the JPEG quality is lowered to meet
+// MaxBytes, below it images are scaled down instead.
+const minImageQuality = 40
+
+// ImageOptions prepare images before they are uploaded. JPEG, PNG and GIF
+// are sent as they are unless they break a limit, WebP, BMP and TIFF are
+// converted. HEIC has no pure Go decoder, such images are sent as
+// attachments, like those above MaxPixels. Re-encoded GIFs keep their
+// first frame only.
+type ImageOptions struct {
+	MaxDimension int         // longest side in pixels, 0 for no limit
+	MaxBytes     int         // 0 for no limit
+	Format       ImageFormat // of re-encoded images, empty keeps the format or uses JPEG
+	Quality      int         // of JPEG images, DefaultImageQuality when 0
+	MaxPixels    int         // decoded at most, DefaultMaxImagePixels when 0
+}
+
+// PrepareMedia applies core.Images to msg, uploads leave a prepared msg
+// as it is. Prepare an image sent to several chats once before sending it.
+func (core *Core) PrepareMedia(msg *MediaMessage) error {
+	if err := core.prepareImage(msg); err != nil {
+		return err
+	}
+	msg.prepared = true
+	return nil
+}
+
+// prepareImage applies core.Images to an Image message. Images that can not
+// be decoded, HEIC or damaged ones, are sent as attachments instead.
+func (core *Core) prepareImage(msg *MediaMessage) error {
+	if core.Images == nil || msg.AsFile || msg.prepared {
+		return nil
+	}
+
+	if mediaType, err := msg.mediaType(); err != nil || mediaType != "pic" {
+		return err
+	}
+
+	fileBytes, format, err := processImage(msg.FileBytes, *core.Images)
+	if err != nil {
+		core.Logger.Debug("image not processed, sending it as a file",
+			"name", msg.Name, "err", err)
+		msg.AsFile = true
+		return nil
+	}
+
+	if len(format) > 0 {
+		ext := filepath.Ext(msg.Name)
+		msg.Name = strings.TrimSuffix(msg.Name, ext) + format.ext()
+	}
+	msg.FileBytes = fileBytes
+	return nil
+}
+
+// processImage returns data unchanged with an empty format when it
+// already fits options, or re-encoded in the returned format.
+func processImage(data []byte, options ImageOptions) ([]byte, ImageFormat, error) {
+	config, name, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	maxPixels := options.MaxPixels
+	if maxPixels <= 0 {
+		maxPixels = DefaultMaxImagePixels
+	}
+	if int64(config.Width)*int64(config.Height) > int64(maxPixels) {
+		return nil, "", ErrImageTooLarge
+	}
+
+	source := ImageFormat(name)
+	format := options.Format
+	if len(format) == 0 {
+		format = source
+		switch {
+		case options.MaxBytes > 0 && len(data) > options.MaxBytes:
+			format = ImageJPEG // the only format that shrinks well
+		case format != ImageJPEG && format != ImagePNG && format != ImageGIF:
+			format = ImageJPEG
+		}
+	}
+
+	orientation := 1
+	if source == ImageJPEG {
+		orientation = jpegOrientation(data)
+	}
+
+	if format == source && orientation == 1 &&
+		(options.MaxDimension <= 0 ||
+			maxInt(config.Width, config.Height) <= options.MaxDimension) &&
+		(options.MaxBytes <= 0 || len(data) <= options.MaxBytes) {
+		return data, "", nil
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	img = orient(img, orientation)
+	if bounds := img.Bounds(); options.MaxDimension > 0 &&
+		maxInt(bounds.Dx(), bounds.Dy()) > options.MaxDimension {
+		img = scale(img, float64(options.MaxDimension)/
+			float64(maxInt(bounds.Dx(), bounds.Dy())))
+	}
+
+	quality := options.Quality
+	if quality <= 0 {
+		quality = DefaultImageQuality
+	}
+
+	for {
+		encoded, err := encodeImage(img, format, quality)
+		if err != nil {
+			return nil, "", err
+		}
+		if options.MaxBytes <= 0 || len(encoded) <= options.MaxBytes {
+			return encoded, format, nil
+		}
+
+		if len(options.Format) == 0 && format != ImageJPEG {
+			format = ImageJPEG
+			continue
+		}
+		if format == ImageJPEG && quality > minImageQuality {
+			quality = maxInt(quality-10, minImageQuality)
+			continue
+		}
+
+		bounds := img.Bounds()
+		if maxInt(bounds.Dx(), bounds.Dy()) <= 64 {
+			return encoded, format, nil // as small as it sensibly gets
+		}
+		img = scale(img, 0.75)
+	}
+}
+
+func encodeImage(img image.Image, format ImageFormat, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case ImagePNG:
+		err = png.Encode(&buf, img)
+	case ImageGIF:
+		err = gif.Encode(&buf, img, nil)
+	default:
+		// JPEG has no alpha, transparent parts turn white instead of black
+		bounds := img.Bounds()
+		opaque := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(opaque, opaque.Bounds(), image.NewUniform(color.White),
+			image.Point{}, draw.Src)
+		draw.Draw(opaque, opaque.Bounds(), img, bounds.Min, draw.Over)
+		err = jpeg.Encode(&buf, opaque, &jpeg.Options{Quality: quality})
+	}
+	return buf.Bytes(), err
+}
+
+func (format ImageFormat) ext() string {
+	if format == ImageJPEG {
+		return ".jpg"
+	}
+	return "." + string(format)
+}
+
+func scale(img image.Image, factor float64) image.Image {
+	bounds := img.Bounds()
+	width := maxInt(int(float64(bounds.Dx())*factor), 1)
+	height := maxInt(int(float64(bounds.Dy())*factor), 1)
+
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+	return scaled
+}
+
+// orient turns img upright according to an EXIF orientation, 1 to 8.
+func orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	w, h := bounds.Dx(), bounds.Dy()
+	dstW, dstH := w, h
+	if orientation >= 5 { // rotated by 90 degrees
+		dstW, dstH = h, w
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		for x := 0; x < dstW; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // upside down
+				sx, sy = w-1-x, h-1-y
+			case 4: // upside down, mirrored
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // needs a clockwise turn
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // needs a counter clockwise turn
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4],
+				src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
+
+// jpegOrientation reads the orientation tag of the EXIF segment of a
+// JPEG, 1 when there is none.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 { // image data starts
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return 1
+		}
+
+		segment := data[i+4 : end]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i = end
+	}
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	// Checked before the conversion, it overflows int on 32 bit builds
+	offset := order.Uint32(tiff[4:])
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return 1
+	}
+	ifd := int(offset)
+
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,273 @@
+package wechat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// withOrientation inserts an EXIF segment with orientation after the SOI
+// marker of a JPEG.
+func withOrientation(data []byte, orientation uint16) []byte {
+	var tiff bytes.Buffer
+	tiff.WriteString("MM\x00\x2a")
+	binary.Write(&tiff, binary.BigEndian, uint32(8))      // first IFD
+	binary.Write(&tiff, binary.BigEndian, uint16(1))      // entries
+	binary.Write(&tiff, binary.BigEndian, uint16(0x0112)) // orientation
+	binary.Write(&tiff, binary.BigEndian, uint16(3))      // SHORT
+	binary.Write(&tiff, binary.BigEndian, uint32(1))      // count
+	binary.Write(&tiff, binary.BigEndian, orientation)
+	binary.Write(&tiff, binary.BigEndian, uint16(0)) // padding
+	binary.Write(&tiff, binary.BigEndian, uint32(0)) // next IFD
+
+	payload := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	return append(append([]byte{0xFF, 0xD8}, segment...), data[2:]...)
+}
+
+func encodeTestImage(t *testing.T, img image.Image, format ImageFormat) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var err error
+	if format == ImagePNG {
+		err = png.Encode(&buf, img)
+	} else {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decodeTestImage(t *testing.T, data []byte) (image.Image, string) {
+	t.Helper()
+
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img, format
+}
+
+func isRed(c color.Color) bool {
+	r, _, b, _ := c.RGBA()
+	return r > 0x8000 && b < 0x8000
+}
+
+func TestProcessImageOrientation(t *testing.T) {
+	// 32x16 and blue, with the stored top left quadrant red
+	stored := image.NewRGBA(image.Rect(0, 0, 32, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 32; x++ {
+			c := color.RGBA{0, 0, 0xff, 0xff}
+			if x < 16 && y < 8 {
+				c = color.RGBA{0xff, 0, 0, 0xff}
+			}
+			stored.Set(x, y, c)
+		}
+	}
+	data := encodeTestImage(t, stored, ImageJPEG)
+
+	tests := []struct {
+		orientation   uint16
+		width, height int
+		redX, redY    int // a pixel near the corner the red quadrant turns to
+	}{
+		{1, 32, 16, 2, 2},
+		{2, 32, 16, 29, 2},
+		{3, 32, 16, 29, 13},
+		{4, 32, 16, 2, 13},
+		{5, 16, 32, 2, 2},
+		{6, 16, 32, 13, 2},
+		{7, 16, 32, 13, 29},
+		{8, 16, 32, 2, 29},
+	}
+
+	for _, test := range tests {
+		oriented := withOrientation(data, test.orientation)
+		if got := jpegOrientation(oriented); got != int(test.orientation) {
+			t.Errorf("jpegOrientation = %d, want %d", got, test.orientation)
+			continue
+		}
+
+		processed, _, err := processImage(oriented, ImageOptions{})
+		if err != nil {
+			t.Fatalf("orientation %d: %v", test.orientation, err)
+		}
+
+		img, _ := decodeTestImage(t, processed)
+		bounds := img.Bounds()
+		if bounds.Dx() != test.width || bounds.Dy() != test.height {
+			t.Errorf("orientation %d: size %dx%d, want %dx%d",
+				test.orientation, bounds.Dx(), bounds.Dy(),
+				test.width, test.height)
+			continue
+		}
+		if !isRed(img.At(test.redX, test.redY)) {
+			t.Errorf("orientation %d: pixel %d,%d is not red",
+				test.orientation, test.redX, test.redY)
+		}
+		if jpegOrientation(processed) != 1 {
+			t.Errorf("orientation %d: processed image is not upright",
+				test.orientation)
+		}
+	}
+}
+
+func TestProcessImage(t *testing.T) {
+	webp, err := os.ReadFile("testdata/blue-purple-pink.lossy.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	small := image.NewRGBA(image.Rect(0, 0, 200, 100))
+	noise := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	random := rand.New(rand.NewSource(1))
+	random.Read(noise.Pix)
+	for i := 3; i < len(noise.Pix); i += 4 {
+		noise.Pix[i] = 0xff
+	}
+
+	tests := []struct {
+		name          string
+		data          []byte
+		options       ImageOptions
+		format        ImageFormat // empty when data is sent unchanged
+		width, height int
+		maxBytes      int
+	}{
+		{"fits", encodeTestImage(t, small, ImagePNG), ImageOptions{MaxDimension: 200},
+			"", 200, 100, 0},
+		{"max dimension", encodeTestImage(t, small, ImagePNG), ImageOptions{MaxDimension: 50},
+			ImagePNG, 50, 25, 0},
+		{"webp to jpeg", webp, ImageOptions{},
+			ImageJPEG, 0, 0, 0},
+		{"max bytes", encodeTestImage(t, noise, ImagePNG), ImageOptions{MaxBytes: 8 * 1024},
+			ImageJPEG, 0, 0, 8 * 1024},
+		{"png format", encodeTestImage(t, small, ImageJPEG), ImageOptions{Format: ImagePNG},
+			ImagePNG, 200, 100, 0},
+	}
+
+	for _, test := range tests {
+		processed, format, err := processImage(test.data, test.options)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if format != test.format {
+			t.Errorf("%s: format %q, want %q", test.name, format, test.format)
+		}
+		if len(test.format) == 0 && !bytes.Equal(processed, test.data) {
+			t.Errorf("%s: data changed", test.name)
+		}
+
+		img, decoded := decodeTestImage(t, processed)
+		if len(test.format) > 0 && ImageFormat(decoded) != test.format {
+			t.Errorf("%s: encoded as %s, want %s", test.name, decoded, test.format)
+		}
+		bounds := img.Bounds()
+		if test.width > 0 && (bounds.Dx() != test.width || bounds.Dy() != test.height) {
+			t.Errorf("%s: size %dx%d, want %dx%d", test.name,
+				bounds.Dx(), bounds.Dy(), test.width, test.height)
+		}
+		if test.maxBytes > 0 && len(processed) > test.maxBytes {
+			t.Errorf("%s: %d bytes, want at most %d", test.name,
+				len(processed), test.maxBytes)
+		}
+	}
+}
+
+func TestPrepareImageFallsBackToFile(t *testing.T) {
+	heic := []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic" +
+		"\x00\x00\x00\x08free")
+	damaged := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0x42}, 64)...)
+
+	core, err := New(CoreOption{Images: &ImageOptions{MaxDimension: 100}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string][]byte{"heic": heic, "damaged": damaged} {
+		msg := MediaMessage{Name: name + ".img", FileBytes: data}
+		if err := core.PrepareMedia(&msg); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !msg.AsFile || !bytes.Equal(msg.FileBytes, data) {
+			t.Errorf("%s: AsFile %v, changed %v, want an unchanged file",
+				name, msg.AsFile, !bytes.Equal(msg.FileBytes, data))
+		}
+	}
+}
+
+func TestPrepareMediaOnce(t *testing.T) {
+	core, err := New(CoreOption{Images: &ImageOptions{MaxDimension: 50}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := MediaMessage{
+		Name:      "small.png",
+		FileBytes: encodeTestImage(t, image.NewRGBA(image.Rect(0, 0, 200, 100)), ImagePNG),
+	}
+	if err := core.PrepareMedia(&msg); err != nil {
+		t.Fatal(err)
+	}
+	prepared := msg.FileBytes
+
+	// Images that were prepared are not processed again
+	core.Images.MaxDimension = 10
+	if err := core.prepareImage(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg.FileBytes, prepared) {
+		t.Error("prepared image was processed again")
+	}
+}
+
+func TestProcessImageLimits(t *testing.T) {
+	// A PNG header declaring a 100000x100000 canvas, nothing decodes it
+	bomb := encodeTestImage(t, image.NewRGBA(image.Rect(0, 0, 1, 1)), ImagePNG)
+	binary.BigEndian.PutUint32(bomb[16:], 100000)
+	binary.BigEndian.PutUint32(bomb[20:], 100000)
+	binary.BigEndian.PutUint32(bomb[29:], crc32.ChecksumIEEE(bomb[12:29]))
+	if _, _, err := processImage(bomb, ImageOptions{}); err != ErrImageTooLarge {
+		t.Errorf("huge canvas: %v, want ErrImageTooLarge", err)
+	}
+
+	small := encodeTestImage(t, image.NewRGBA(image.Rect(0, 0, 200, 100)), ImagePNG)
+	if _, _, err := processImage(small, ImageOptions{MaxPixels: 10000}); err != ErrImageTooLarge {
+		t.Errorf("over MaxPixels: %v, want ErrImageTooLarge", err)
+	}
+}
+
+func TestExifOrientationOffsets(t *testing.T) {
+	tests := []struct {
+		name string
+		tiff []byte
+	}{
+		{"short", []byte("MM\x00\x2a")},
+		{"unknown order", []byte("XX\x00\x2a\x00\x00\x00\x08")},
+		{"offset past the end", []byte("MM\x00\x2a\x00\x00\x00\x10")},
+		{"offset above 2^31", []byte("MM\x00\x2a\xff\xff\xff\xf0")},
+		{"entries past the end", []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x05")},
+	}
+
+	for _, test := range tests {
+		if got := exifOrientation(test.tiff); got != 1 {
+			t.Errorf("%s: orientation %d, want 1", test.name, got)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package wechat
+
+// Logger receives the log records of a Core, args are alternating keys
+// and values. *slog.Logger implements it.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+const redacted = "[redacted]"
+
+// secret hides message content, tickets and keys from the log when
+// RedactLogs is set.
+func (core *Core) secret(value string) string {
+	if core.RedactLogs && len(value) > 0 {
+		return redacted
+	}
+	return value
+}
@@ -0,0 +1,34 @@
+//go:build !go1.21
+
+package wechat
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// stdLogger writes to the standard logger where log/slog is missing,
+// debug records are dropped like slog does by default.
+type stdLogger struct{}
+
+func (stdLogger) Debug(msg string, args ...any) {}
+
+func (stdLogger) Info(msg string, args ...any) { stdLog("INFO", msg, args) }
+
+func (stdLogger) Warn(msg string, args ...any) { stdLog("WARN", msg, args) }
+
+func (stdLogger) Error(msg string, args ...any) { stdLog("ERROR", msg, args) }
+
+func stdLog(level string, msg string, args []any) {
+	var line strings.Builder
+	line.WriteString(level + " " + msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&line, " %v=%v", args[i], args[i+1])
+	}
+	log.Print(line.String())
+}
+
+func defaultLogger() Logger {
+	return stdLogger{}
+}
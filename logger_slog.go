@@ -0,0 +1,9 @@
+//go:build go1.21
+
+package wechat
+
+import "log/slog"
+
+func defaultLogger() Logger {
+	return slog.Default()
+}
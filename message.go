@@ -9,6 +9,7 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/binarycraft007/wechat/utils"
@@ -42,15 +43,217 @@ const (
 type MediaMessage struct {
 	Name      string
 	FileBytes []byte
+	AsFile    bool // send as an attachment whatever the type, unprocessed
+	prepared  bool // core.Images were applied by PrepareMedia
+}
+
+// mediaType is the mediatype field of the upload, "pic", "video", "doc"
+// or "audio".
+func (msg *MediaMessage) mediaType() (string, error) {
+	if msg.AsFile {
+		return "doc", nil
+	}
+	mediaType, err := utils.DetectMediaType(msg.FileBytes)
+	if err != nil {
+		return "", err
+	}
+	return *mediaType, nil
+}
+
+// SplitGroupContent splits the content of a group message into the
+// UserName of the sender and the actual text, which the server joins as
+// "@sender:<br/>text". Content without the prefix is returned as is.
+func SplitGroupContent(content string) (string, string) {
+	if !strings.HasPrefix(content, "@") {
+		return "", content
+	}
+
+	idx := strings.Index(content, ":<br/>")
+	if idx == -1 {
+		return "", content
+	}
+
+	return content[:idx], content[idx+len(":<br/>"):]
 }
 
 func (core *Core) SendMsg(msgAny interface{}, to string) error {
+	_, err := core.SendMessage(msgAny, to)
+	return err
+}
+
+// SendMessage works like SendMsg but also returns the server response,
+// which carries the MsgID of the sent message.
+func (core *Core) SendMessage(msgAny interface{}, to string) (*SendMsgResponse, error) {
+	key := outboxKey{clientMsgId: core.newClientMsgId(), to: to}
+	return core.sendMsg(msgAny, to, key)
+}
+
+// newClientMsgId returns a millisecond timestamp times 1000 plus a counter,
+// so messages sent within the same millisecond get distinct ids.
+func (core *Core) newClientMsgId() int64 {
+	milliseconds := time.Now().UnixMilli()
+	return milliseconds*1000 + int64(core.msgSeq.Add(1)%1000)
+}
+
+// ReplayOutbox sends the messages a previous session left pending in the
+// outbox. UserNames only live as long as a login session, so recipients
+// that are gone are looked up by remark name, then by nickname. Entries
+// whose recipient can not be found unambiguously stay pending, like those
+// failing with ErrQueued, and are reported in the returned error.
+func (core *Core) ReplayOutbox() error {
+	if core.Outbox == nil {
+		return nil
+	}
+
+	var errs []error
+	for _, entry := range core.Outbox.Pending() {
+		to := entry.To
+		if _, ok := core.Contact(to); !ok {
+			contact, err := core.outboxRecipient(entry)
+			if err != nil {
+				core.Logger.Warn("outbox recipient not resolved",
+					"clientMsgId", entry.ClientMsgId, "err", err)
+				errs = append(errs, fmt.Errorf("outbox message %d: %w",
+					entry.ClientMsgId, err))
+				continue
+			}
+			to = contact.UserName
+		}
+
+		msg, err := core.Outbox.message(entry)
+		if err != nil {
+			core.Outbox.Abandon(entry.ClientMsgId, entry.To)
+			errs = append(errs, fmt.Errorf("outbox message %d: %w",
+				entry.ClientMsgId, err))
+			continue
+		}
+
+		if _, err := core.sendMsg(msg, to, entry.key()); err != nil {
+			core.Logger.Warn("outbox replay failed",
+				"clientMsgId", entry.ClientMsgId, "err", err)
+			errs = append(errs, fmt.Errorf("outbox message %d: %w",
+				entry.ClientMsgId, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// outboxRecipient finds the contact of an entry whose UserName expired.
+// Names are not unique, so several matches are an error rather than a
+// guess.
+func (core *Core) outboxRecipient(entry OutboxEntry) (Contact, error) {
+	match := func(name func(Contact) string, want string) (Contact, error) {
+		var found []Contact
+		for _, contact := range core.Contacts() {
+			if name(contact) == want {
+				found = append(found, contact)
+			}
+		}
+		switch len(found) {
+		case 0:
+			return Contact{}, ErrRecipientNotFound
+		case 1:
+			return found[0], nil
+		default:
+			return Contact{}, ErrRecipientAmbiguous
+		}
+	}
+
+	if len(entry.ToRemark) > 0 {
+		contact, err := match(func(c Contact) string { return c.RemarkName },
+			entry.ToRemark)
+		if err != ErrRecipientNotFound {
+			return contact, err
+		}
+	}
+	if len(entry.ToNickName) > 0 {
+		return match(func(c Contact) string { return c.NickName },
+			entry.ToNickName)
+	}
+	return Contact{}, ErrRecipientNotFound
+}
+
+// sendMsg sends msgAny to the UserName to. key identifies the message in
+// the outbox, its recipient differs from to when a replayed message was
+// addressed with the UserName of an earlier session.
+func (core *Core) sendMsg(msgAny interface{}, to string, key outboxKey) (*SendMsgResponse, error) {
+	// Sent before, nothing goes out so nothing is counted
+	if core.Outbox != nil && core.Outbox.IsDone(key.clientMsgId, key.to) {
+		return &SendMsgResponse{}, nil
+	}
+
+	result, err := core.postMsg(msgAny, to, key)
+	core.observeSend(msgAny, err)
+	return result, err
+}
+
+// postMsg keeps msgAny in the outbox while it is sent. Sends that could not
+// reach the server, logged out or failing in transport, stay queued for
+// the next login and fail with ErrQueued. Any other error is returned to
+// the sender, who decides whether to send again, so the entry is dropped.
+func (core *Core) postMsg(msgAny interface{}, to string, key outboxKey) (*SendMsgResponse, error) {
+	if core.Outbox == nil {
+		return core.post(msgAny, to, key.clientMsgId)
+	}
+
+	contact, _ := core.Contact(to)
+	entry := OutboxEntry{
+		ClientMsgId: key.clientMsgId,
+		To:          key.to,
+		ToNickName:  contact.NickName,
+		ToRemark:    contact.RemarkName,
+	}
+
+	switch msg := msgAny.(type) {
+	case string:
+		entry.Text = &msg
+	case MediaMessage:
+		entry.Media = &msg
+	default:
+		return nil, ErrInvalidMsgType
+	}
+
+	if err := core.Outbox.Add(entry); err != nil {
+		return nil, err
+	}
+
+	if core.LoginState() != LoggedIn {
+		return nil, fmt.Errorf("%w: not logged in", ErrQueued)
+	}
+
+	result, err := core.post(msgAny, to, key.clientMsgId)
+	if err != nil {
+		if core.unreached(err) {
+			return nil, fmt.Errorf("%w: %w", ErrQueued, err)
+		}
+		if abandonErr := core.Outbox.Abandon(key.clientMsgId, key.to); abandonErr != nil {
+			core.Logger.Warn("abandon outbox entry failed",
+				"clientMsgId", key.clientMsgId, "err", abandonErr)
+		}
+		return nil, err
+	}
+
+	if err := core.Outbox.Complete(key.clientMsgId, key.to); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// unreached reports whether err means the message did not get to the
+// server, or the server dropped the session.
+func (core *Core) unreached(err error) bool {
+	var urlErr *url.Error
+	var retErr *RetError
+	return errors.As(err, &urlErr) ||
+		(errors.As(err, &retErr) && retErr.Ret == core.Config.SyncCheckRetLogout)
+}
+
+func (core *Core) post(msgAny interface{}, to string, clientMsgId int64) (*SendMsgResponse, error) {
 	params := url.Values{}
 	params.Add("pass_ticket", core.SessionData.PassTicket)
 	params.Add("lang", "zh_CN")
 
-	clientMsgId := utils.GetClientMsgId()
-
 	var uri string
 	var messageReq MessageRequest
 
@@ -71,26 +274,31 @@ func (core *Core) SendMsg(msgAny interface{}, to string) error {
 	msgMedia, validMedia := msgAny.(MediaMessage)
 	if validMedia {
 		var msgType MessageType
-		mediaType, err := utils.DetectMediaType(msgMedia.FileBytes)
-		if err != nil {
-			return err
+		if _, err := msgMedia.mediaType(); err != nil {
+			return nil, err
 		}
 
 		params.Add("fun", "async")
 		params.Add("f", "json")
 		resp, err := core.UploadMedia(&msgMedia)
 		if err != nil {
-			return err
+			return nil, err
+		}
+
+		// Uploading may have converted the media or made it an attachment
+		mediaType, err := msgMedia.mediaType()
+		if err != nil {
+			return nil, err
 		}
 
 		var content string = ""
-		if *mediaType == "pic" {
+		if mediaType == "pic" {
 			uri = core.Config.Api.SendMsgImg
 			msgType = Image
-		} else if *mediaType == "video" {
+		} else if mediaType == "video" {
 			uri = core.Config.Api.SendVideoMsg
 			msgType = Video
-		} else if *mediaType == "doc" {
+		} else if mediaType == "doc" {
 			uri = core.Config.Api.SendAppMsg
 			msgType = Attach
 			mtype := mimetype.Detect(msgMedia.FileBytes)
@@ -101,7 +309,7 @@ func (core *Core) SendMsg(msgAny interface{}, to string) error {
 				Ext:     mtype.Extension()[1:],
 			})
 		} else {
-			return ErrInvalidMsgType
+			return nil, ErrInvalidMsgType
 		}
 
 		messageReq = MessageRequest{
@@ -117,21 +325,25 @@ func (core *Core) SendMsg(msgAny interface{}, to string) error {
 		} else {
 			messageReq.MediaId = &resp.MediaID
 		}
+
+		if msgType == Video {
+			core.addVideoInfo(&msgMedia, &messageReq)
+		}
 	}
 
 	if !validText && !validMedia {
-		return ErrInvalidMsgType
+		return nil, ErrInvalidMsgType
 	}
 
 	u, err := url.ParseRequestURI(uri)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	u.RawQuery = params.Encode()
 
 	baseRequest, err := core.GetBaseRequest()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	data := SendMsgRequest{
@@ -145,49 +357,78 @@ func (core *Core) SendMsg(msgAny interface{}, to string) error {
 	encoder.SetEscapeHTML(false)
 	err = encoder.Encode(data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	reqBody := bytes.NewReader(buf.Bytes())
 	req, err := http.NewRequest("POST", u.String(), reqBody)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
 
-	resp, err := core.Client.Do(req)
+	resp, err := core.do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		errMsg := utils.GetErrorMsgInt(resp.StatusCode)
-		return errors.New(errMsg)
+		return nil, errors.New(errMsg)
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var result SendMsgResponse
 	if err := json.Unmarshal(body, &result); err != nil {
-		return err
+		return nil, err
 	}
 
 	if result.BaseResponse.Ret != 0 {
-		errMsg := utils.GetErrorMsgInt(result.BaseResponse.Ret)
-		return errors.New(errMsg)
+		core.Logger.Warn("send rejected", "endpoint", uri, "chat", to,
+			"ret", result.BaseResponse.Ret)
+		return nil, &RetError{Ret: result.BaseResponse.Ret}
+	}
+
+	sent := Message{
+		MsgID:        result.MsgID,
+		FromUserName: core.User.UserName,
+		ToUserName:   to,
+		MsgType:      int(messageReq.Type),
+		CreateTime:   int(time.Now().Unix()),
+		FileName:     msgMedia.Name,
 	}
+	if messageReq.Content != nil {
+		sent.Content = *messageReq.Content
+	}
+	core.recordHistory(sent)
+	core.Logger.Debug("message sent", "endpoint", uri, "chat", to,
+		"msg_id", result.MsgID, "content", core.secret(sent.Content))
 
-	return nil
+	return &result, nil
 }
 
+// UploadMedia uploads msg, images are prepared with core.Images first
+// which may change the name and bytes of msg.
 func (core *Core) UploadMedia(msg *MediaMessage) (*UploadMediaResponse, error) {
-	mediaType, err := utils.DetectMediaType(msg.FileBytes)
+	if err := core.prepareImage(msg); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	result, err := core.uploadMedia(msg)
+	core.observeUpload(msg, start, err)
+	return result, err
+}
+
+func (core *Core) uploadMedia(msg *MediaMessage) (*UploadMediaResponse, error) {
+	mediaType, err := msg.mediaType()
 	if err != nil {
 		return nil, err
 	}
@@ -206,7 +447,7 @@ func (core *Core) UploadMedia(msg *MediaMessage) (*UploadMediaResponse, error) {
 	}
 	u.RawQuery = params.Encode()
 
-	clientMsgId := utils.GetClientMsgId()
+	clientMsgId := core.newClientMsgId()
 
 	data := UploadMediaRequest{
 		BaseRequest:   *baseRequest,
@@ -235,7 +476,7 @@ func (core *Core) UploadMedia(msg *MediaMessage) (*UploadMediaResponse, error) {
 	writer.WriteField("type", mimetype.Detect(msg.FileBytes).String())
 	writer.WriteField("lastModifiedDate", gmt)
 	writer.WriteField("size", fmt.Sprintf("%d", len(msg.FileBytes)))
-	writer.WriteField("mediatype", *mediaType)
+	writer.WriteField("mediatype", mediaType)
 	writer.WriteField("uploadmediarequest", string(marshalled))
 	writer.WriteField("webwx_data_ticket", core.SessionData.DataTicket)
 	writer.WriteField("pass_ticket", core.SessionData.PassTicket)
@@ -259,7 +500,7 @@ func (core *Core) UploadMedia(msg *MediaMessage) (*UploadMediaResponse, error) {
 	req.Header.Set("Content-Type", writer.FormDataContentType())
 	req.Header.Set("Accept", "application/json")
 
-	resp, err := core.Client.Do(req)
+	resp, err := core.do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -281,9 +522,72 @@ func (core *Core) UploadMedia(msg *MediaMessage) (*UploadMediaResponse, error) {
 	}
 
 	if result.BaseResponse.Ret != 0 {
-		errMsg := utils.GetErrorMsgInt(result.BaseResponse.Ret)
-		return nil, errors.New(errMsg)
+		core.Logger.Warn("upload rejected",
+			"endpoint", core.Config.Api.UploadMedia,
+			"ret", result.BaseResponse.Ret)
+		return nil, &RetError{Ret: result.BaseResponse.Ret}
 	}
 
 	return &result, nil
 }
+
+func (core *Core) GetMsgImg(msgID string) ([]byte, error) {
+	return core.getMsgMedia(core.Config.Api.GetMsgImg, msgID)
+}
+
+func (core *Core) GetVoice(msgID string) ([]byte, error) {
+	return core.getMsgMedia(core.Config.Api.GetVoice, msgID)
+}
+
+func (core *Core) GetVideo(msgID string) ([]byte, error) {
+	return core.getMsgMedia(core.Config.Api.GetVideo, msgID)
+}
+
+// DownloadMedia fetches the image, voice or video attached to msg.
+func (core *Core) DownloadMedia(msgID string, msgType MessageType) ([]byte, error) {
+	switch msgType {
+	case Image, Emoticon:
+		return core.GetMsgImg(msgID)
+	case Voice:
+		return core.GetVoice(msgID)
+	case Video, MicroVideo:
+		return core.GetVideo(msgID)
+	}
+	return nil, ErrInvalidMsgType
+}
+
+func (core *Core) getMsgMedia(uri string, msgID string) ([]byte, error) {
+	params := url.Values{}
+	params.Add("MsgID", msgID)
+	params.Add("skey", core.SessionData.Skey)
+
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if uri == core.Config.Api.GetVideo {
+		// The video endpoint only answers range requests
+		req.Header.Set("Range", "bytes=0-")
+	}
+
+	resp, err := core.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK &&
+		resp.StatusCode != http.StatusPartialContent {
+		errMsg := utils.GetErrorMsgInt(resp.StatusCode)
+		return nil, errors.New(errMsg)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
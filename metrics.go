@@ -0,0 +1,73 @@
+package wechat
+
+import (
+	"errors"
+	"time"
+)
+
+// Metrics receives measurements of the sync, send and upload paths of a
+// Core. All methods are called synchronously, so they should be cheap.
+type Metrics interface {
+	// ObserveSyncCheck is called after every synccheck, selector is only
+	// meaningful when err is nil.
+	ObserveSyncCheck(duration time.Duration, selector SyncType, err error)
+	ObserveMessageReceived(msgType MessageType)
+	// ObserveSend is called for every message sent, ret is the Ret of the
+	// BaseResponse, 0 when the request failed before the server answered.
+	ObserveSend(msgType MessageType, ret int, err error)
+	ObserveUpload(size int, duration time.Duration, err error)
+}
+
+func (core *Core) observeSyncCheck(start time.Time, err error) {
+	if core.Metrics != nil {
+		core.Metrics.ObserveSyncCheck(time.Since(start), core.SyncSelector, err)
+	}
+}
+
+func (core *Core) observeReceived(messages []Message) {
+	if core.Metrics == nil {
+		return
+	}
+	for _, msg := range messages {
+		core.Metrics.ObserveMessageReceived(MessageType(msg.MsgType))
+	}
+}
+
+func (core *Core) observeSend(msgAny interface{}, err error) {
+	if core.Metrics == nil {
+		return
+	}
+
+	var msgType MessageType
+	switch msg := msgAny.(type) {
+	case string:
+		msgType = Text
+	case MediaMessage:
+		if mediaType, err := msg.mediaType(); err == nil {
+			switch mediaType {
+			case "pic":
+				msgType = Image
+			case "video":
+				msgType = Video
+			case "doc":
+				msgType = Attach
+			}
+		}
+	}
+
+	core.Metrics.ObserveSend(msgType, retCode(err), err)
+}
+
+func (core *Core) observeUpload(msg *MediaMessage, start time.Time, err error) {
+	if core.Metrics != nil {
+		core.Metrics.ObserveUpload(len(msg.FileBytes), time.Since(start), err)
+	}
+}
+
+func retCode(err error) int {
+	var retErr *RetError
+	if errors.As(err, &retErr) {
+		return retErr.Ret
+	}
+	return 0
+}
@@ -34,6 +34,9 @@ type MessageRequest struct {
 	ToUserName   string      `json:"ToUserName"`
 	LocalID      int64       `json:"LocalID"`
 	ClientMsgId  int64       `json:"ClientMsgId"`
+	PlayLength   int         `json:"PlayLength,omitempty"` // seconds, of videos
+	ImgWidth     int         `json:"ImgWidth,omitempty"`
+	ImgHeight    int         `json:"ImgHeight,omitempty"`
 }
 
 type UploadMediaRequest struct {
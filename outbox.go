@@ -0,0 +1,347 @@
+package wechat
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// outboxCompactEvery is the number of finished entries after which the
+// log is rewritten.
+const outboxCompactEvery = 1000
+
+type OutboxEntry struct {
+	ClientMsgId int64         `json:"ClientMsgId"`
+	To          string        `json:"To,omitempty"`
+	ToNickName  string        `json:"ToNickName,omitempty"`
+	ToRemark    string        `json:"ToRemark,omitempty"`
+	Text        *string       `json:"Text,omitempty"`
+	Media       *MediaMessage `json:"Media,omitempty"` // without FileBytes
+	MediaFile   string        `json:"MediaFile,omitempty"`
+	CreateTime  int64         `json:"CreateTime,omitempty"`
+	Done        bool          `json:"Done,omitempty"`
+	Abandoned   bool          `json:"Abandoned,omitempty"` // done, but not sent
+}
+
+// Outbox is an append-only log of outgoing messages. Every message is
+// written before it is sent and marked done once the server accepted it,
+// or abandoned once the sender was told it failed, so whatever is still
+// pending after a restart can be sent again. Entries are keyed on their
+// ClientMsgId and recipient. Media is kept in files next to the log,
+// named by their hash so a message to several chats is stored once.
+type Outbox struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	order    []outboxKey
+	pending  map[outboxKey]OutboxEntry
+	done     map[outboxKey]bool // since the last compaction
+	finished int                // entries done since the last compaction
+}
+
+type outboxKey struct {
+	clientMsgId int64
+	to          string
+}
+
+func (entry OutboxEntry) key() outboxKey {
+	return outboxKey{clientMsgId: entry.ClientMsgId, to: entry.To}
+}
+
+func NewOutbox(path string) (*Outbox, error) {
+	outbox := Outbox{
+		path:    path,
+		pending: make(map[outboxKey]OutboxEntry),
+		done:    make(map[outboxKey]bool),
+	}
+
+	if err := outbox.load(); err != nil {
+		return nil, err
+	}
+
+	if err := outbox.compact(); err != nil {
+		return nil, err
+	}
+
+	return &outbox, nil
+}
+
+func (outbox *Outbox) load() error {
+	file, err := os.Open(outbox.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var entry OutboxEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A torn write at the tail of the log, ignore it
+			continue
+		}
+		outbox.apply(entry)
+	}
+
+	return scanner.Err()
+}
+
+func (outbox *Outbox) apply(entry OutboxEntry) bool {
+	key := entry.key()
+	if entry.Done {
+		// Logs written before entries were keyed on the recipient complete
+		// without one, which matches every recipient
+		completed := false
+		order := outbox.order[:0]
+		for _, pending := range outbox.order {
+			if pending == key || (len(key.to) == 0 &&
+				pending.clientMsgId == key.clientMsgId) {
+				delete(outbox.pending, pending)
+				outbox.done[pending] = true
+				completed = true
+				continue
+			}
+			order = append(order, pending)
+		}
+		outbox.order = order
+		return completed
+	}
+
+	if _, ok := outbox.pending[key]; ok {
+		return false
+	}
+	if outbox.isDone(key) {
+		return false
+	}
+	outbox.pending[key] = entry
+	outbox.order = append(outbox.order, key)
+	return true
+}
+
+func (outbox *Outbox) isDone(key outboxKey) bool {
+	return outbox.done[key] ||
+		outbox.done[outboxKey{clientMsgId: key.clientMsgId}]
+}
+
+// compact rewrites the log so that it only holds pending entries, and
+// forgets the done ones together with their media.
+func (outbox *Outbox) compact() error {
+	tmpPath := outbox.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for _, key := range outbox.order {
+		if err := encoder.Encode(outbox.pending[key]); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, outbox.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(outbox.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if outbox.file != nil {
+		outbox.file.Close()
+	}
+	outbox.file = file
+	outbox.done = make(map[outboxKey]bool)
+	outbox.finished = 0
+
+	return outbox.removeMedia()
+}
+
+func (outbox *Outbox) mediaDir() string {
+	return outbox.path + ".media"
+}
+
+// removeMedia deletes the media files no pending entry refers to.
+func (outbox *Outbox) removeMedia() error {
+	files, err := os.ReadDir(outbox.mediaDir())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	used := make(map[string]bool)
+	for _, entry := range outbox.pending {
+		used[entry.MediaFile] = true
+	}
+	for _, file := range files {
+		if !used[file.Name()] {
+			os.Remove(filepath.Join(outbox.mediaDir(), file.Name()))
+		}
+	}
+	return nil
+}
+
+// writeMedia stores data in a file named by its hash and returns the name.
+func (outbox *Outbox) writeMedia(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	name := hex.EncodeToString(sum[:])
+	path := filepath.Join(outbox.mediaDir(), name)
+	if _, err := os.Stat(path); err == nil {
+		return name, nil
+	}
+
+	if err := os.MkdirAll(outbox.mediaDir(), 0700); err != nil {
+		return "", err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return "", err
+	}
+	return name, os.Rename(tmpPath, path)
+}
+
+func (outbox *Outbox) write(entry OutboxEntry) error {
+	marshalled, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if _, err := outbox.file.Write(append(marshalled, '\n')); err != nil {
+		return err
+	}
+
+	return outbox.file.Sync()
+}
+
+// Add persists entry unless a message with the same ClientMsgId and
+// recipient is already pending or was completed before.
+func (outbox *Outbox) Add(entry OutboxEntry) error {
+	outbox.mu.Lock()
+	defer outbox.mu.Unlock()
+
+	entry.Done = false
+	entry.Abandoned = false
+	if entry.CreateTime == 0 {
+		entry.CreateTime = time.Now().Unix()
+	}
+
+	key := entry.key()
+	if _, ok := outbox.pending[key]; ok || outbox.isDone(key) {
+		return nil
+	}
+
+	if entry.Media != nil && len(entry.Media.FileBytes) > 0 {
+		name, err := outbox.writeMedia(entry.Media.FileBytes)
+		if err != nil {
+			return err
+		}
+		media := *entry.Media
+		media.FileBytes = nil
+		entry.Media = &media
+		entry.MediaFile = name
+	}
+
+	outbox.apply(entry)
+	return outbox.write(entry)
+}
+
+// Complete marks the message as accepted by the server.
+func (outbox *Outbox) Complete(clientMsgId int64, to string) error {
+	return outbox.finish(OutboxEntry{ClientMsgId: clientMsgId, To: to,
+		Done: true})
+}
+
+// Abandon drops a message that failed for good, or whose error was
+// returned to the sender, who may send it again.
+func (outbox *Outbox) Abandon(clientMsgId int64, to string) error {
+	return outbox.finish(OutboxEntry{ClientMsgId: clientMsgId, To: to,
+		Done: true, Abandoned: true})
+}
+
+func (outbox *Outbox) finish(entry OutboxEntry) error {
+	outbox.mu.Lock()
+	defer outbox.mu.Unlock()
+
+	if !outbox.apply(entry) {
+		return nil
+	}
+	if err := outbox.write(entry); err != nil {
+		return err
+	}
+
+	if outbox.finished++; outbox.finished >= outboxCompactEvery {
+		return outbox.compact()
+	}
+	return nil
+}
+
+func (outbox *Outbox) IsDone(clientMsgId int64, to string) bool {
+	outbox.mu.Lock()
+	defer outbox.mu.Unlock()
+
+	return outbox.isDone(outboxKey{clientMsgId: clientMsgId, to: to})
+}
+
+func (outbox *Outbox) Pending() []OutboxEntry {
+	outbox.mu.Lock()
+	defer outbox.mu.Unlock()
+
+	entries := make([]OutboxEntry, 0, len(outbox.order))
+	for _, key := range outbox.order {
+		entries = append(entries, outbox.pending[key])
+	}
+	return entries
+}
+
+func (outbox *Outbox) Close() error {
+	outbox.mu.Lock()
+	defer outbox.mu.Unlock()
+
+	return outbox.file.Close()
+}
+
+// message returns the text or media of entry, reading the media file.
+func (outbox *Outbox) message(entry OutboxEntry) (interface{}, error) {
+	if entry.Text != nil {
+		return *entry.Text, nil
+	}
+	if entry.Media == nil {
+		return nil, ErrInvalidMsgType
+	}
+
+	media := *entry.Media
+	if len(entry.MediaFile) > 0 {
+		data, err := os.ReadFile(filepath.Join(outbox.mediaDir(),
+			entry.MediaFile))
+		if err != nil {
+			return nil, err
+		}
+		media.FileBytes = data
+	}
+	return media, nil
+}
@@ -0,0 +1,225 @@
+package wechat
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOutboxKeysOnRecipient(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	outbox, err := NewOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text := "hi"
+	for _, to := range []string{"@a", "@b"} {
+		err := outbox.Add(OutboxEntry{ClientMsgId: 1, To: to, Text: &text})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := outbox.Complete(1, "@a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !outbox.IsDone(1, "@a") || outbox.IsDone(1, "@b") {
+		t.Fatalf("done = %v, %v, want true, false",
+			outbox.IsDone(1, "@a"), outbox.IsDone(1, "@b"))
+	}
+	outbox.Close()
+
+	outbox, err = NewOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outbox.Close()
+
+	pending := outbox.Pending()
+	if len(pending) != 1 || pending[0].To != "@b" {
+		t.Fatalf("pending = %+v, want the message to @b", pending)
+	}
+}
+
+func TestOutboxLegacyDone(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	log := `{"ClientMsgId":1,"To":"@a","Text":"hi"}
+{"ClientMsgId":1,"Done":true}
+`
+	if err := os.WriteFile(path, []byte(log), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	outbox, err := NewOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outbox.Close()
+
+	if pending := outbox.Pending(); len(pending) != 0 {
+		t.Fatalf("pending = %+v, want none", pending)
+	}
+	// Done entries are pruned by the compaction on open
+	if data, _ := os.ReadFile(path); len(data) != 0 {
+		t.Fatalf("log after compaction = %q, want it empty", data)
+	}
+}
+
+func TestOutboxRecipient(t *testing.T) {
+	core := Core{}
+	core.setContacts([]Contact{
+		{UserName: "@1", NickName: "alice", RemarkName: "Alice W"},
+		{UserName: "@2", NickName: "alice"},
+		{UserName: "@3", NickName: "bob"},
+	})
+
+	tests := []struct {
+		entry OutboxEntry
+		want  string
+		err   error
+	}{
+		{OutboxEntry{ToRemark: "Alice W", ToNickName: "alice"}, "@1", nil},
+		{OutboxEntry{ToNickName: "bob"}, "@3", nil},
+		{OutboxEntry{ToRemark: "Bobby", ToNickName: "bob"}, "@3", nil},
+		{OutboxEntry{ToNickName: "alice"}, "", ErrRecipientAmbiguous},
+		{OutboxEntry{ToNickName: "carol"}, "", ErrRecipientNotFound},
+		{OutboxEntry{}, "", ErrRecipientNotFound},
+	}
+
+	for _, test := range tests {
+		contact, err := core.outboxRecipient(test.entry)
+		if err != test.err || contact.UserName != test.want {
+			t.Errorf("outboxRecipient(%+v) = %q, %v, want %q, %v",
+				test.entry, contact.UserName, err, test.want, test.err)
+		}
+	}
+}
+
+func TestNewClientMsgIdUnique(t *testing.T) {
+	core := Core{}
+	seen := make(map[int64]bool)
+	for i := 0; i < 500; i++ {
+		id := core.newClientMsgId()
+		if seen[id] {
+			t.Fatalf("id %d returned twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestOutboxMediaFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	outbox, err := NewOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outbox.Close()
+
+	data := bytes.Repeat([]byte{0x42}, 1024)
+	for _, to := range []string{"@a", "@b"} {
+		media := MediaMessage{Name: "a.bin", FileBytes: data}
+		if err := outbox.Add(OutboxEntry{ClientMsgId: 1, To: to, Media: &media}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	log, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(log, []byte("FileBytes\":\"")) {
+		t.Errorf("media bytes stored in the log:\n%s", log)
+	}
+	files, _ := os.ReadDir(outbox.mediaDir())
+	if len(files) != 1 {
+		t.Errorf("%d media files, want one for both recipients", len(files))
+	}
+
+	msg, err := outbox.message(outbox.Pending()[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if media, ok := msg.(MediaMessage); !ok || !bytes.Equal(media.FileBytes, data) {
+		t.Errorf("message = %+v, want the media read back", msg)
+	}
+
+	outbox.Complete(1, "@a")
+	outbox.Abandon(1, "@b")
+	outbox.mu.Lock()
+	err = outbox.compact()
+	done := len(outbox.done)
+	outbox.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if done != 0 {
+		t.Errorf("%d done keys after compaction, want none", done)
+	}
+	if files, _ := os.ReadDir(outbox.mediaDir()); len(files) != 0 {
+		t.Errorf("%d media files after compaction, want none", len(files))
+	}
+}
+
+func TestPostMsgOutbox(t *testing.T) {
+	var response func(req *http.Request) (*http.Response, error)
+	core, err := New(CoreOption{
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			return response(req)
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	core.SessionData.Uin = "1"
+	if core.Outbox, err = NewOutbox(filepath.Join(t.TempDir(), "outbox.jsonl")); err != nil {
+		t.Fatal(err)
+	}
+	defer core.Outbox.Close()
+
+	tests := []struct {
+		name     string
+		loggedIn bool
+		response func(req *http.Request) (*http.Response, error)
+		queued   bool
+	}{
+		{"logged out", false, nil, true},
+		{"transport", true, func(req *http.Request) (*http.Response, error) {
+			return nil, errors.New("connection reset")
+		}, true},
+		{"session gone", true, func(req *http.Request) (*http.Response, error) {
+			return jsonResponse(req, `{"BaseResponse":{"Ret":1101}}`), nil
+		}, true},
+		{"rejected", true, func(req *http.Request) (*http.Response, error) {
+			return jsonResponse(req, `{"BaseResponse":{"Ret":1}}`), nil
+		}, false},
+		{"sent", true, func(req *http.Request) (*http.Response, error) {
+			return jsonResponse(req, `{"BaseResponse":{"Ret":0},"MsgID":"1"}`), nil
+		}, false},
+	}
+
+	queued := 0
+	for _, test := range tests {
+		core.setLoginState(LoginIdle)
+		if test.loggedIn {
+			core.setLoginState(LoggedIn)
+		}
+		response = test.response
+
+		_, err := core.SendMessage("hi", "@"+strings.ReplaceAll(test.name, " ", "-"))
+		if got := errors.Is(err, ErrQueued); got != test.queued {
+			t.Errorf("%s: %v, want queued %v", test.name, err, test.queued)
+		}
+		if test.queued {
+			queued++
+		}
+		if pending := len(core.Outbox.Pending()); pending != queued {
+			t.Errorf("%s: %d pending, want %d", test.name, pending, queued)
+		}
+	}
+}
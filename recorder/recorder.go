@@ -0,0 +1,387 @@
+// Package recorder captures the HTTP traffic of a Core into fixture files
+// and serves it back, so protocol bugs can be reproduced without an
+// account:
+//
+//	rec, err := recorder.NewRecorder("login.jsonl", nil)
+//	core, err := wechat.New(wechat.CoreOption{Transport: rec})
+//	...
+//	rec.Close()
+//
+//	core, err := wechat.New(wechat.CoreOption{
+//		Transport: recorder.MustReplayer("login.jsonl"),
+//	})
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+var ErrNoInteraction = errors.New("no recorded interaction left")
+
+// Redacted replaces every redacted value.
+const Redacted = "REDACTED"
+
+// DefaultKeys are the query parameters, cookies, form fields, XML tags and
+// JSON fields a Recorder redacts, compared case-insensitively.
+var DefaultKeys = []string{
+	"skey", "sid", "wxsid", "uin", "wxuin", "pass_ticket", "passticket",
+	"webwx_data_ticket", "ticket", "deviceid", "content",
+}
+
+type Interaction struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+type Request struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+	Body   Body        `json:"body,omitempty"`
+}
+
+type Response struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       Body        `json:"body,omitempty"`
+}
+
+// Body is stored as a string, or as {"base64": ...} when it is not valid
+// UTF-8.
+type Body []byte
+
+func (body Body) MarshalJSON() ([]byte, error) {
+	if utf8.Valid(body) {
+		return json.Marshal(string(body))
+	}
+	return json.Marshal(struct {
+		Base64 string `json:"base64"`
+	}{base64.StdEncoding.EncodeToString(body)})
+}
+
+func (body *Body) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*body = Body(text)
+		return nil
+	}
+
+	var encoded struct {
+		Base64 string `json:"base64"`
+	}
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded.Base64)
+	if err != nil {
+		return err
+	}
+	*body = decoded
+	return nil
+}
+
+// Recorder is a RoundTripper that appends every request and response
+// passing through it, redacted, to a JSON lines file.
+type Recorder struct {
+	transport http.RoundTripper
+	redactor  *redactor
+	mu        sync.Mutex
+	file      *os.File
+}
+
+// NewRecorder truncates path and records into it. Requests are sent with
+// transport, http.DefaultTransport when nil.
+func NewRecorder(path string, transport http.RoundTripper) (*Recorder, error) {
+	return NewRecorderKeys(path, transport, DefaultKeys)
+}
+
+// NewRecorderKeys works like NewRecorder but redacts keys instead of
+// DefaultKeys, leave out "content" to keep message texts.
+func NewRecorderKeys(path string, transport http.RoundTripper, keys []string) (*Recorder, error) {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Recorder{
+		transport: transport,
+		redactor:  newRedactor(keys),
+		file:      file,
+	}, nil
+}
+
+func (recorder *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		if reqBody, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	resp, err := recorder.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	redact := recorder.redactor
+	interaction := Interaction{
+		Request: Request{
+			Method: req.Method,
+			URL:    redact.url(req.URL.String()),
+			Header: redact.header(req.Header),
+			Body:   redact.body(reqBody),
+		},
+		Response: Response{
+			StatusCode: resp.StatusCode,
+			Header:     redact.header(resp.Header),
+			Body:       redact.body(respBody),
+		},
+	}
+
+	if err := recorder.write(interaction); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (recorder *Recorder) write(interaction Interaction) error {
+	marshalled, err := json.Marshal(interaction)
+	if err != nil {
+		return err
+	}
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+
+	_, err = recorder.file.Write(append(marshalled, '\n'))
+	return err
+}
+
+func (recorder *Recorder) Close() error {
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+
+	return recorder.file.Close()
+}
+
+// Replayer is a RoundTripper answering from a file written by a Recorder.
+// A request gets the first unused interaction with the same method and
+// URL path, query and body are ignored since they carry timestamps.
+type Replayer struct {
+	mu           sync.Mutex
+	interactions []Interaction
+	used         []bool
+}
+
+func NewReplayer(path string) (*Replayer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	replayer := Replayer{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var interaction Interaction
+		if err := json.Unmarshal(scanner.Bytes(), &interaction); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		replayer.interactions = append(replayer.interactions, interaction)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	replayer.used = make([]bool, len(replayer.interactions))
+	return &replayer, nil
+}
+
+// MustReplayer is like NewReplayer but panics on error, for tests.
+func MustReplayer(path string) *Replayer {
+	replayer, err := NewReplayer(path)
+	if err != nil {
+		panic(err)
+	}
+	return replayer
+}
+
+func (replayer *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	replayer.mu.Lock()
+	defer replayer.mu.Unlock()
+
+	for i, interaction := range replayer.interactions {
+		if replayer.used[i] || interaction.Request.Method != req.Method ||
+			pathOf(interaction.Request.URL) != req.URL.Path {
+			continue
+		}
+		replayer.used[i] = true
+
+		recorded := interaction.Response
+		header := recorded.Header.Clone()
+		if header == nil {
+			header = make(http.Header)
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", recorded.StatusCode, http.StatusText(recorded.StatusCode)),
+			StatusCode:    recorded.StatusCode,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        header,
+			Body:          io.NopCloser(bytes.NewReader(recorded.Body)),
+			ContentLength: int64(len(recorded.Body)),
+			Request:       req,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s %s", ErrNoInteraction, req.Method, req.URL.Path)
+}
+
+// Pending returns how many interactions were not replayed yet.
+func (replayer *Replayer) Pending() int {
+	replayer.mu.Lock()
+	defer replayer.mu.Unlock()
+
+	pending := 0
+	for _, used := range replayer.used {
+		if !used {
+			pending++
+		}
+	}
+	return pending
+}
+
+func pathOf(rawURL string) string {
+	path := rawURL
+	if i := strings.Index(path, "://"); i >= 0 {
+		path = path[i+len("://"):]
+		if j := strings.IndexByte(path, '/'); j >= 0 {
+			path = path[j:]
+		} else {
+			path = "/"
+		}
+	}
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	return path
+}
+
+// redactor blanks the values of its keys wherever the protocol puts them:
+// query strings, cookies, multipart fields, XML tags and JSON fields.
+type redactor struct {
+	param     *regexp.Regexp
+	xml       *regexp.Regexp
+	jsonStr   *regexp.Regexp
+	jsonNum   *regexp.Regexp
+	multipart *regexp.Regexp
+}
+
+func newRedactor(keys []string) *redactor {
+	quoted := make([]string, len(keys))
+	for i, key := range keys {
+		quoted[i] = regexp.QuoteMeta(key)
+	}
+	alt := "(?:" + strings.Join(quoted, "|") + ")"
+
+	return &redactor{
+		param:     regexp.MustCompile(`(?i)((?:^|[?&;\s])` + alt + `=)[^&;"'\s<]*`),
+		xml:       regexp.MustCompile(`(?i)(<(` + alt + `)>)[^<]*(</)`),
+		jsonStr:   regexp.MustCompile(`(?i)("` + alt + `"\s*:\s*")(?:[^"\\]|\\.)*"`),
+		jsonNum:   regexp.MustCompile(`(?i)("` + alt + `"\s*:\s*)-?\d+`),
+		multipart: regexp.MustCompile(`(?i)(name="` + alt + `"\r\n\r\n)[^\r]*`),
+	}
+}
+
+func (r *redactor) bytes(data []byte) []byte {
+	data = r.param.ReplaceAll(data, []byte("${1}"+Redacted))
+	data = r.xml.ReplaceAll(data, []byte("${1}"+Redacted+"${3}"))
+	data = r.jsonStr.ReplaceAll(data, []byte(`${1}`+Redacted+`"`))
+	data = r.jsonNum.ReplaceAll(data, []byte("${1}0"))
+	data = r.multipart.ReplaceAll(data, []byte("${1}"+Redacted))
+	return data
+}
+
+func (r *redactor) url(rawURL string) string {
+	return string(r.bytes([]byte(rawURL)))
+}
+
+func (r *redactor) body(body []byte) Body {
+	if len(body) == 0 {
+		return nil
+	}
+	return Body(r.bytes(body))
+}
+
+// header redacts cookies completely, their names are kept. The length of
+// the body changes with redaction, so Content-Length is dropped.
+func (r *redactor) header(header http.Header) http.Header {
+	if len(header) == 0 {
+		return nil
+	}
+
+	redacted := header.Clone()
+	redacted.Del("Content-Length")
+	for _, name := range []string{"Cookie", "Set-Cookie"} {
+		for i, value := range redacted[name] {
+			redacted[name][i] = redactCookie(value)
+		}
+	}
+	return redacted
+}
+
+func redactCookie(value string) string {
+	parts := strings.Split(value, ";")
+	for i, part := range parts {
+		name, _, ok := strings.Cut(part, "=")
+		if !ok {
+			continue
+		}
+		// Attributes of a Set-Cookie header are not secret
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "path", "domain", "expires", "max-age", "samesite":
+			if i > 0 {
+				continue
+			}
+		}
+		parts[i] = name + "=" + Redacted
+	}
+	return strings.Join(parts, ";")
+}
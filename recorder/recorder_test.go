@@ -0,0 +1,93 @@
+package recorder
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	image := []byte{0xff, 0xd8, 0xff, 0xe0, 0x00}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cgi-bin/mmwebwx-bin/webwxinit":
+			http.SetCookie(w, &http.Cookie{Name: "wxsid", Value: "secret-sid"})
+			io.WriteString(w, `{"SKey":"secret-skey","Count":1}`)
+		case "/cgi-bin/mmwebwx-bin/webwxgetmsgimg":
+			w.Write(image)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	path := filepath.Join(t.TempDir(), "fixture.jsonl")
+	rec, err := NewRecorder(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := http.Client{Transport: rec}
+	initURL := server.URL + "/cgi-bin/mmwebwx-bin/webwxinit?pass_ticket=secret-ticket"
+	imageURL := server.URL + "/cgi-bin/mmwebwx-bin/webwxgetmsgimg?MsgID=1"
+	for _, u := range []string{initURL, imageURL} {
+		resp, err := client.Post(u, "application/json",
+			strings.NewReader(`{"BaseRequest":{"Sid":"secret-sid"}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+
+	fixture, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(fixture), "secret") {
+		t.Errorf("fixture is not redacted:\n%s", fixture)
+	}
+
+	replayer, err := NewReplayer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = http.Client{Transport: replayer}
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{initURL, `{"SKey":"REDACTED","Count":1}`},
+		{imageURL, string(image)},
+	}
+	for _, test := range tests {
+		resp, err := client.Post(test.url, "application/json", nil)
+		if err != nil {
+			t.Fatalf("replay %s: %v", test.url, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusOK || string(body) != test.want {
+			t.Errorf("replay %s = %d %q, want 200 %q", test.url,
+				resp.StatusCode, body, test.want)
+		}
+	}
+
+	if pending := replayer.Pending(); pending != 0 {
+		t.Errorf("%d interactions not replayed", pending)
+	}
+	if _, err := client.Post(initURL, "application/json", nil); !errors.Is(err, ErrNoInteraction) {
+		t.Errorf("replay past the fixture: %v, want ErrNoInteraction", err)
+	}
+}
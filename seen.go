@@ -0,0 +1,88 @@
+package wechat
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+)
+
+const DefaultSeenMsgCapacity = 1024
+
+// seenCache is a bounded LRU of message ids already handed to handlers.
+type seenCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	items    map[string]*list.Element
+}
+
+func newSeenCache(capacity int) *seenCache {
+	if capacity <= 0 {
+		capacity = DefaultSeenMsgCapacity
+	}
+	return &seenCache{
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// add records key and reports whether it was new.
+func (cache *seenCache) add(key string) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if elem, ok := cache.items[key]; ok {
+		cache.order.MoveToFront(elem)
+		return false
+	}
+
+	cache.items[key] = cache.order.PushFront(key)
+	for cache.order.Len() > cache.capacity {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.items, oldest.Value.(string))
+	}
+	return true
+}
+
+// keys returns the cached keys from oldest to newest.
+func (cache *seenCache) keys() []string {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	keys := make([]string, 0, cache.order.Len())
+	for elem := cache.order.Back(); elem != nil; elem = elem.Prev() {
+		keys = append(keys, elem.Value.(string))
+	}
+	return keys
+}
+
+func msgKeys(msg Message) []string {
+	var keys []string
+	if len(msg.MsgID) > 0 {
+		keys = append(keys, msg.MsgID)
+	}
+	if msg.NewMsgID != 0 {
+		keys = append(keys, "n"+strconv.FormatInt(msg.NewMsgID, 10))
+	}
+	return keys
+}
+
+// filterSeen drops the messages that were already delivered in this
+// session, e.g. when a sync is repeated with a stale key.
+func (core *Core) filterSeen(messages []Message) []Message {
+	var fresh []Message
+	for _, msg := range messages {
+		seen := false
+		for _, key := range msgKeys(msg) {
+			if !core.seen.add(key) {
+				seen = true
+			}
+		}
+		if !seen {
+			fresh = append(fresh, msg)
+		}
+	}
+	return fresh
+}
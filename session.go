@@ -0,0 +1,207 @@
+package wechat
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/binarycraft007/wechat/utils"
+)
+
+// resumeAttempts is how often Init is tried when resuming a session, as
+// long as it fails for other reasons than the server refusing the session.
+const resumeAttempts = 3
+
+// Session is what Core writes to its session file, enough to tell
+// which messages of the session were already handled after a restart
+// and to resume the session while the server still accepts it.
+type Session struct {
+	SessionData  SessionData               `json:"SessionData"`
+	Host         string                    `json:"Host"`
+	User         User                      `json:"User"`
+	SyncKey      SyncKey                   `json:"SyncKey"`
+	SyncCheckKey SyncKey                   `json:"SyncCheckKey"`
+	SeenMsgIDs   []string                  `json:"SeenMsgIDs"`
+	Cookies      map[string][]*http.Cookie `json:"Cookies,omitempty"` // by url
+}
+
+func (core *Core) SaveSession(path string) error {
+	u, err := url.Parse(core.Config.Origin)
+	if err != nil {
+		return err
+	}
+
+	session := Session{
+		SessionData:  core.SessionData,
+		Host:         u.Hostname(),
+		User:         core.User,
+		SyncKey:      core.SyncKey,
+		SyncCheckKey: core.SyncCheckKey,
+		SeenMsgIDs:   core.seen.keys(),
+		Cookies:      core.cookies(),
+	}
+
+	marshalled, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a
+	// truncated session behind.
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, marshalled, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+func (core *Core) LoadSession(path string) (*Session, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+
+	for _, key := range session.SeenMsgIDs {
+		core.seen.add(key)
+	}
+
+	return &session, nil
+}
+
+func (core *Core) saveSession() {
+	if len(core.SessionFile) == 0 {
+		return
+	}
+
+	if err := core.SaveSession(core.SessionFile); err != nil {
+		core.Logger.Error("save session failed",
+			"file", core.SessionFile, "err", err)
+	}
+}
+
+// ResumeSession logs in with the session persisted to SessionFile instead
+// of a qrcode. It fails with ErrAlreadyLoggedOut once the server ended
+// that session and with ErrNoSession when nothing was persisted. Network
+// errors are retried until ctx is done. The persisted sync keys replace
+// the ones from Init, so messages that arrived meanwhile are still synced.
+func (core *Core) ResumeSession(ctx context.Context) error {
+	if len(core.SessionFile) == 0 {
+		return ErrNoSession
+	}
+
+	session, err := core.LoadSession(core.SessionFile)
+	if os.IsNotExist(err) {
+		return ErrNoSession
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(session.SessionData.Uin) == 0 ||
+		len(session.SessionData.Skey) == 0 {
+		return ErrNoSession
+	}
+
+	config, err := utils.NewConfig(utils.ConfigOption{Host: session.Host})
+	if err != nil {
+		return err
+	}
+
+	core.Config = *config
+	core.SessionData = session.SessionData
+	if len(core.SessionData.DeviceID) == 0 {
+		core.SessionData.DeviceID = utils.GetDeviceID(core.rand)
+	}
+	core.User = session.User
+
+	if core.Client.Jar != nil {
+		for rawURL, cookies := range session.Cookies {
+			u, err := url.Parse(rawURL)
+			if err != nil {
+				continue
+			}
+			core.Client.Jar.SetCookies(u, cookies)
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := core.Init()
+		if err == nil {
+			core.restoreSyncKeys(session)
+			return nil
+		}
+		var retErr *RetError
+		if err == ErrAlreadyLoggedOut ||
+			errors.As(err, &retErr) || attempt == resumeAttempts {
+			return err
+		}
+		core.Logger.Warn("resume session failed, retrying",
+			"attempt", attempt, "err", err)
+
+		timer := time.NewTimer(time.Duration(attempt) * time.Second)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+func (core *Core) restoreSyncKeys(session *Session) {
+	if session.SyncKey.Count > 0 {
+		core.SyncKey = session.SyncKey
+	}
+	if session.SyncCheckKey.Count > 0 {
+		core.SyncCheckKey = session.SyncCheckKey
+		core.SetFormatedSyncKey(core.SyncCheckKey)
+	}
+	core.saveSession()
+}
+
+// sessionURLs are where the hosts of a session set their cookies, the
+// jar only hands out name and value so they are kept per url.
+func (core *Core) sessionURLs() []*url.URL {
+	var urls []*url.URL
+	for _, rawURL := range []string{
+		core.Config.Api.Init,
+		core.Config.Api.SyncCheck,
+		core.Config.Api.UploadMedia,
+	} {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			continue
+		}
+		urls = append(urls, &url.URL{
+			Scheme: u.Scheme,
+			Host:   u.Host,
+			Path:   "/cgi-bin/mmwebwx-bin/",
+		})
+	}
+	return urls
+}
+
+func (core *Core) cookies() map[string][]*http.Cookie {
+	if core.Client.Jar == nil {
+		return nil
+	}
+
+	cookies := make(map[string][]*http.Cookie)
+	for _, u := range core.sessionURLs() {
+		if jarCookies := core.Client.Jar.Cookies(u); len(jarCookies) > 0 {
+			cookies[u.String()] = jarCookies
+		}
+	}
+	return cookies
+}
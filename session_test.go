@@ -0,0 +1,173 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (fn roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return fn(req)
+}
+
+func jsonResponse(req *http.Request, body string) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}
+}
+
+const initResponse = `{"BaseResponse":{"Ret":0},"User":{"UserName":"@me"},` +
+	`"SyncKey":{"Count":1,"List":[{"Key":1,"Val":1}]}}`
+
+func saveTestSession(t *testing.T, path string) {
+	t.Helper()
+
+	core, err := New(CoreOption{SessionFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	core.SessionData.Uin = "1"
+	core.SessionData.Skey = "@skey"
+	core.SyncKey = SyncKey{Count: 1, List: []struct {
+		Key int `json:"Key"`
+		Val int `json:"Val"`
+	}{{Key: 1, Val: 5}}}
+	core.SyncCheckKey = SyncKey{Count: 1, List: []struct {
+		Key int `json:"Key"`
+		Val int `json:"Val"`
+	}{{Key: 1, Val: 6}}}
+
+	for _, u := range core.sessionURLs() {
+		core.Client.Jar.SetCookies(u, []*http.Cookie{
+			{Name: "wxsid", Value: "sid-" + u.Host},
+		})
+	}
+	if err := core.SaveSession(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResumeSessionRestoresCookies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.json")
+	saveTestSession(t, path)
+
+	var cookie string
+	core, err := New(CoreOption{
+		SessionFile: path,
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			if strings.HasSuffix(req.URL.Path, "/webwxinit") {
+				cookie = req.Header.Get("Cookie")
+			}
+			return jsonResponse(req, initResponse), nil
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := core.ResumeSession(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	initURL, _ := url.Parse(core.Config.Api.Init)
+	if want := "wxsid=sid-" + initURL.Host; cookie != want {
+		t.Errorf("init sent cookie %q, want %q", cookie, want)
+	}
+	if core.LoginState() != LoggedIn {
+		t.Errorf("login state %d after resume, want LoggedIn", core.LoginState())
+	}
+	if val := core.SyncKey.List[0].Val; val != 5 {
+		t.Errorf("sync key %d after resume, want the persisted 5", val)
+	}
+	if core.FormatedSyncKey != "1_6" {
+		t.Errorf("formatted sync key %q after resume, want the persisted 1_6",
+			core.FormatedSyncKey)
+	}
+}
+
+func TestResumeSessionRetriesTransientErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.json")
+	saveTestSession(t, path)
+
+	calls := 0
+	core, err := New(CoreOption{
+		SessionFile: path,
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			if calls == 1 {
+				return nil, errors.New("connection reset")
+			}
+			return jsonResponse(req, initResponse), nil
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := core.ResumeSession(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("init called %d times, want 2", calls)
+	}
+}
+
+func TestResumeSessionStopsWhenLoggedOut(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.json")
+	saveTestSession(t, path)
+
+	calls := 0
+	core, err := New(CoreOption{
+		SessionFile: path,
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			return jsonResponse(req, `{"BaseResponse":{"Ret":1101}}`), nil
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := core.ResumeSession(context.Background()); err != ErrAlreadyLoggedOut {
+		t.Fatalf("resume = %v, want ErrAlreadyLoggedOut", err)
+	}
+	if calls != 1 {
+		t.Errorf("init called %d times, want 1", calls)
+	}
+}
+
+func TestResumeSessionStopsWhenCanceled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.json")
+	saveTestSession(t, path)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	core, err := New(CoreOption{
+		SessionFile: path,
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			cancel()
+			return nil, errors.New("connection reset")
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := core.ResumeSession(ctx); err != context.Canceled {
+		t.Fatalf("resume = %v, want context.Canceled", err)
+	}
+	if calls != 1 {
+		t.Errorf("init called %d times, want 1", calls)
+	}
+}
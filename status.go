@@ -0,0 +1,65 @@
+package wechat
+
+import "time"
+
+// Status is a snapshot of the health of a Core.
+type Status struct {
+	LoginState   LoginState
+	LoggedIn     bool
+	LoginSince   time.Time // when LoggedIn last changed
+	InitTime     time.Time // zero until the session is initialized
+	LastSyncTime time.Time // last successful synccheck
+	// ConsecutiveErrors counts the SyncPolling calls that failed since
+	// the last one that succeeded, LastError is the latest of them.
+	ConsecutiveErrors int
+	LastError         string
+	// The login in progress, or the logged in user
+	QrCodeUrl     string
+	QrCodeContent string
+	Avatar        string
+	User          User
+}
+
+func (core *Core) Status() Status {
+	core.statusMu.Lock()
+	defer core.statusMu.Unlock()
+
+	status := Status{
+		LoginState:        core.loginState,
+		LoggedIn:          core.loginState == LoggedIn,
+		LoginSince:        core.loginSince,
+		InitTime:          core.initTime,
+		ConsecutiveErrors: core.syncErrors,
+		QrCodeUrl:         core.QrCodeUrl,
+		QrCodeContent:     core.QrCodeContent,
+		Avatar:            core.Avatar,
+		User:              core.User,
+	}
+	if core.LastSyncTime > 0 {
+		status.LastSyncTime = time.Unix(0, core.LastSyncTime)
+	}
+	if core.lastSyncError != nil {
+		status.LastError = core.lastSyncError.Error()
+	}
+	return status
+}
+
+func (core *Core) recordSyncResult(err error) {
+	core.statusMu.Lock()
+	defer core.statusMu.Unlock()
+
+	if err == nil {
+		core.syncErrors = 0
+		core.lastSyncError = nil
+		return
+	}
+	core.syncErrors++
+	core.lastSyncError = err
+}
+
+func (core *Core) setLastSyncTime(t time.Time) {
+	core.statusMu.Lock()
+	defer core.statusMu.Unlock()
+
+	core.LastSyncTime = t.UnixNano()
+}
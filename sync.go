@@ -6,7 +6,6 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -27,6 +26,10 @@ const (
 
 type SyncFunc = func(data *SyncResponse) error
 
+// Upper bound of extra webwxsync calls while ContinueFlag is set, the
+// remaining data is picked up by the next synccheck.
+const maxSyncContinue = 16
+
 func (core *Core) StatusNotify() error {
 	params := url.Values{}
 	params.Add("pass_ticket", core.SessionData.PassTicket)
@@ -75,7 +78,7 @@ func (core *Core) StatusNotify() error {
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
 
-	resp, err := core.Client.Do(req)
+	resp, err := core.do(req)
 	if err != nil {
 		return err
 	}
@@ -112,7 +115,7 @@ func (core *Core) SyncCheck() error {
 	params.Add("sid", core.SessionData.Sid)
 	params.Add("uin", core.SessionData.Uin)
 	params.Add("skey", core.SessionData.Skey)
-	params.Add("deviceid", utils.GetDeviceID())
+	params.Add("deviceid", core.SessionData.DeviceID)
 	params.Add("synckey", core.FormatedSyncKey)
 
 	u, err := url.ParseRequestURI(core.Config.Api.SyncCheck)
@@ -127,7 +130,7 @@ func (core *Core) SyncCheck() error {
 		return err
 	}
 
-	resp, err := core.Client.Do(req)
+	resp, err := core.do(req)
 	if err != nil {
 		return err
 	}
@@ -139,6 +142,8 @@ func (core *Core) SyncCheck() error {
 	}
 
 	if strings.Contains(string(body), "retcode:\"1101\"") {
+		core.Logger.Warn("session gone",
+			"endpoint", core.Config.Api.SyncCheck, "ret", 1101)
 		return ErrAlreadyLoggedOut
 	}
 
@@ -152,6 +157,8 @@ func (core *Core) SyncCheck() error {
 		return err
 	}
 	core.SyncSelector = SyncType(selector)
+	core.Logger.Debug("sync check",
+		"endpoint", core.Config.Api.SyncCheck, "selector", selector)
 
 	return nil
 }
@@ -196,7 +203,7 @@ func (core *Core) Sync() (*SyncResponse, error) {
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
 
-	resp, err := core.Client.Do(req)
+	resp, err := core.do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -218,16 +225,70 @@ func (core *Core) Sync() (*SyncResponse, error) {
 	}
 
 	if result.BaseResponse.Ret != 0 {
+		core.Logger.Warn("sync rejected",
+			"endpoint", core.Config.Api.Sync, "ret", result.BaseResponse.Ret)
 		errMsg := utils.GetErrorMsgInt(result.BaseResponse.Ret)
 		return nil, errors.New(errMsg)
 	}
 
-	core.SyncKey = result.SyncCheckKey
-	core.SetFormatedSyncKey(core.SyncKey)
+	if result.SyncKey.Count > 0 {
+		core.SyncKey = result.SyncKey
+	}
+	if result.SyncCheckKey.Count > 0 {
+		core.SyncCheckKey = result.SyncCheckKey
+		core.SetFormatedSyncKey(core.SyncCheckKey)
+	}
+	if len(result.SKey) > 0 {
+		core.SessionData.Skey = result.SKey
+	}
 
 	return &result, nil
 }
 
+// SyncAll calls Sync for as long as the server reports more pending data
+// through ContinueFlag and merges all batches into one response. Every
+// Sync advances the sync key, so when a later call fails the batches
+// received until then are returned together with the error.
+func (core *Core) SyncAll() (*SyncResponse, error) {
+	data, err := core.Sync()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; data.ContinueFlag != 0 && i < maxSyncContinue; i++ {
+		next, err := core.Sync()
+		if err != nil {
+			return data, err
+		}
+		mergeSyncResponse(data, next)
+	}
+
+	return data, nil
+}
+
+func mergeSyncResponse(data *SyncResponse, next *SyncResponse) {
+	data.AddMsgList = append(data.AddMsgList, next.AddMsgList...)
+	data.AddMsgCount = len(data.AddMsgList)
+	data.ModContactList = append(data.ModContactList, next.ModContactList...)
+	data.ModContactCount = len(data.ModContactList)
+	data.DelContactList = append(data.DelContactList, next.DelContactList...)
+	data.DelContactCount = len(data.DelContactList)
+	data.ModChatRoomMemberList = append(data.ModChatRoomMemberList,
+		next.ModChatRoomMemberList...)
+	data.ModChatRoomMemberCount = len(data.ModChatRoomMemberList)
+
+	if next.Profile.BitFlag != 0 {
+		data.Profile = next.Profile
+	}
+	if len(next.SKey) > 0 {
+		data.SKey = next.SKey
+	}
+
+	data.ContinueFlag = next.ContinueFlag
+	data.SyncKey = next.SyncKey
+	data.SyncCheckKey = next.SyncCheckKey
+}
+
 func (core *Core) SetFormatedSyncKey(syncKey SyncKey) {
 	syncKeyList := make([]string, len(syncKey.List))
 	for i, item := range syncKey.List {
@@ -237,26 +298,55 @@ func (core *Core) SetFormatedSyncKey(syncKey SyncKey) {
 	core.FormatedSyncKey = strings.Join(syncKeyList, "|")
 }
 
+// SyncPolling checks for updates once and dispatches them to the sync
+// funcs, see Status for the outcome of past calls.
 func (core *Core) SyncPolling() error {
-	if err := core.SyncCheck(); err != nil {
+	err := core.syncPolling()
+	core.recordSyncResult(err)
+	return err
+}
+
+func (core *Core) syncPolling() error {
+	start := time.Now()
+	err := core.SyncCheck()
+	core.observeSyncCheck(start, err)
+	if err != nil {
 		return err
 	}
+	core.setLastSyncTime(time.Now())
 
 	if core.SyncSelector == Normal {
 		return nil
 	}
 
-	var err error
-	var data *SyncResponse
-	if data, err = core.Sync(); err != nil {
+	data, err := core.SyncAll()
+	if data == nil {
 		return err
 	}
 
-	core.LastSyncTime = time.Now().UnixNano()
+	// Dispatch what was received even if a later batch failed, the sync
+	// key already moved past it
+	if dispatchErr := core.dispatchSync(data); err == nil {
+		err = dispatchErr
+	}
+	return err
+}
+
+func (core *Core) dispatchSync(data *SyncResponse) error {
+	data.AddMsgList = core.filterSeen(data.AddMsgList)
+	data.AddMsgCount = len(data.AddMsgList)
+	core.observeReceived(data.AddMsgList)
+	for _, msg := range data.AddMsgList {
+		core.Logger.Debug("message received",
+			"chat", msg.FromUserName, "msg_id", msg.MsgID,
+			"type", msg.MsgType, "content", core.secret(msg.Content))
+	}
+	core.saveSession()
 
 	switch core.SyncSelector {
 	case MessageContact:
 		core.modDelContact(data) // This will not fail
+		core.recordHistory(data.AddMsgList...)
 		if core.SyncMsgFunc == nil || data.AddMsgCount == 0 {
 			goto sync_contact
 		}
@@ -272,9 +362,9 @@ func (core *Core) SyncPolling() error {
 			return err
 		}
 	case ModProfile:
-		fmt.Println("profile modified") // TODO Handle this
+		core.Logger.Debug("profile modified") // TODO Handle this
 	case ModChatRoom:
-		fmt.Println("chatroom modified") // TODO Handle this
+		core.Logger.Debug("chatroom modified") // TODO Handle this
 	}
 
 	return nil
@@ -284,16 +374,16 @@ func (core *Core) modDelContact(data *SyncResponse) {
 	if data.ModContactCount > 0 {
 		// Handle new contacts
 		for _, contact := range data.ModContactList {
-			log.Println("mod contact: " + contact.UserName)
-			core.ContactMap[contact.UserName] = contact
+			core.Logger.Debug("contact modified", "user", contact.UserName)
+			core.putContacts(contact)
 		}
 	}
 
 	if data.DelContactCount > 0 {
 		// Handle new contacts
 		for _, contact := range data.DelContactList {
-			log.Println("del contact: " + contact.UserName)
-			delete(core.ContactMap, contact.UserName)
+			core.Logger.Debug("contact deleted", "user", contact.UserName)
+			core.deleteContact(contact.UserName)
 		}
 	}
 }
@@ -0,0 +1,165 @@
+package wechat
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func syncBatch(cont int, syncKey int, checkKey int, ids ...string) string {
+	msgs := make([]string, len(ids))
+	for i, id := range ids {
+		msgs[i] = fmt.Sprintf(`{"MsgId":%q}`, id)
+	}
+	return fmt.Sprintf(`{"BaseResponse":{"Ret":0},"AddMsgCount":%d,`+
+		`"AddMsgList":[%s],"ContinueFlag":%d,`+
+		`"SyncKey":{"Count":1,"List":[{"Key":1,"Val":%d}]},`+
+		`"SyncCheckKey":{"Count":1,"List":[{"Key":1,"Val":%d}]}}`,
+		len(ids), strings.Join(msgs, ","), cont, syncKey, checkKey)
+}
+
+func TestSyncAllMergesBatches(t *testing.T) {
+	var sent []int
+	core, err := New(CoreOption{
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			var body SyncRequest
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			val := 0
+			if len(body.SyncKey.List) > 0 {
+				val = body.SyncKey.List[0].Val
+			}
+			sent = append(sent, val)
+			if len(sent) == 1 {
+				return jsonResponse(req, syncBatch(1, 10, 20, "a", "b")), nil
+			}
+			return jsonResponse(req, syncBatch(0, 11, 21, "c")), nil
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	core.SessionData.Uin = "1"
+
+	data, err := core.SyncAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, msg := range data.AddMsgList {
+		ids = append(ids, msg.MsgID)
+	}
+	if got := strings.Join(ids, ","); got != "a,b,c" || data.AddMsgCount != 3 {
+		t.Errorf("merged messages %q (count %d), want a,b,c", got, data.AddMsgCount)
+	}
+	if data.ContinueFlag != 0 {
+		t.Errorf("merged continue flag %d, want 0", data.ContinueFlag)
+	}
+	if len(sent) != 2 || sent[1] != 10 {
+		t.Errorf("sync requests sent keys %v, want the second to carry 10", sent)
+	}
+	if val := data.SyncKey.List[0].Val; val != 11 {
+		t.Errorf("merged sync key %d, want 11", val)
+	}
+	if val := data.SyncCheckKey.List[0].Val; val != 21 {
+		t.Errorf("merged sync check key %d, want 21", val)
+	}
+	if val := core.SyncKey.List[0].Val; val != 11 {
+		t.Errorf("core sync key %d, want 11", val)
+	}
+	if val := core.SyncCheckKey.List[0].Val; val != 21 {
+		t.Errorf("core sync check key %d, want 21", val)
+	}
+	if core.FormatedSyncKey != "1_21" {
+		t.Errorf("formatted sync key %q, want the sync check key 1_21", core.FormatedSyncKey)
+	}
+}
+
+func TestSyncAllStopsAtContinueCap(t *testing.T) {
+	calls := 0
+	core, err := New(CoreOption{
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			calls++
+			return jsonResponse(req, syncBatch(1, calls, calls, fmt.Sprint(calls))), nil
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	core.SessionData.Uin = "1"
+
+	data, err := core.SyncAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1+maxSyncContinue {
+		t.Errorf("sync called %d times, want %d", calls, 1+maxSyncContinue)
+	}
+	if data.AddMsgCount != calls {
+		t.Errorf("merged %d messages, want %d", data.AddMsgCount, calls)
+	}
+}
+
+func TestSeenCacheEvictsLeastRecent(t *testing.T) {
+	cache := newSeenCache(2)
+	for _, key := range []string{"a", "b"} {
+		if !cache.add(key) {
+			t.Fatalf("%s reported seen on first add", key)
+		}
+	}
+	if cache.add("a") {
+		t.Error("a reported new on second add")
+	}
+	cache.add("c") // evicts b, a was touched more recently
+
+	if got := strings.Join(cache.keys(), ","); got != "a,c" {
+		t.Errorf("cached keys %q, want a,c", got)
+	}
+	if !cache.add("b") {
+		t.Error("evicted b reported seen")
+	}
+}
+
+func TestDispatchSyncDropsSeen(t *testing.T) {
+	core, err := New(CoreOption{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var delivered []string
+	core.SyncSelector = MessageContact
+	core.SyncMsgFunc = func(data *SyncResponse) error {
+		for _, msg := range data.AddMsgList {
+			delivered = append(delivered, msg.MsgID)
+		}
+		return nil
+	}
+
+	batch := func(ids ...string) *SyncResponse {
+		var data SyncResponse
+		if err := json.Unmarshal([]byte(syncBatch(0, 1, 1, ids...)), &data); err != nil {
+			t.Fatal(err)
+		}
+		return &data
+	}
+	// The retried sync repeats a and b after a stale key.
+	for _, data := range []*SyncResponse{batch("a", "b"), batch("a", "b", "c")} {
+		if err := core.dispatchSync(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := core.dispatchSync(&SyncResponse{AddMsgList: []Message{{NewMsgID: 7}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := core.dispatchSync(&SyncResponse{AddMsgList: []Message{{NewMsgID: 7}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := strings.Join(delivered, ","); got != "a,b,c," {
+		t.Errorf("delivered %q, want a,b,c and one message without MsgID", got)
+	}
+}
@@ -0,0 +1,250 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"time"
+
+	"github.com/binarycraft007/wechat/utils"
+)
+
+const DefaultUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/113.0.0.0 Safari/537.36"
+
+// Timeouts bound whole requests, reading the response body included, by
+// endpoint. Zero fields take the value of DefaultTimeouts, negative ones
+// disable the timeout.
+type Timeouts struct {
+	SyncCheck time.Duration // long polls held open by the server
+	SendMsg   time.Duration
+	Upload    time.Duration
+	Download  time.Duration // images, voice and video of messages
+	Default   time.Duration // every other endpoint
+}
+
+var DefaultTimeouts = Timeouts{
+	SyncCheck: 40 * time.Second,
+	SendMsg:   15 * time.Second,
+	Upload:    5 * time.Minute,
+	Download:  5 * time.Minute,
+	Default:   30 * time.Second,
+}
+
+// RequestHook is called with every outgoing request and may modify it.
+type RequestHook func(req *http.Request)
+
+// ResponseHook is called once the response headers of req arrived or the
+// request failed.
+type ResponseHook func(req *http.Request, resp *http.Response, err error)
+
+type noRedirectKey struct{}
+
+// withoutRedirects makes the client return the redirect response itself
+// for requests made with the returned context.
+func withoutRedirects(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noRedirectKey{}, true)
+}
+
+// newClient builds the client of core from options.Client, or a new one,
+// wrapping its transport to apply timeouts, the user agent and hooks.
+func (core *Core) newClient(options CoreOption) (*http.Client, error) {
+	var client http.Client
+	if options.Client != nil {
+		client = *options.Client
+	}
+
+	base := client.Transport
+	if options.Transport != nil {
+		base = options.Transport
+	}
+
+	if len(options.ProxyURL) > 0 {
+		if base != nil {
+			return nil, ErrProxyWithTransport
+		}
+		proxy, err := url.Parse(options.ProxyURL)
+		if err != nil {
+			return nil, err
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = http.ProxyURL(proxy)
+		base = transport
+	}
+
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	if options.Jar != nil {
+		client.Jar = options.Jar
+	}
+	if client.Jar == nil {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			return nil, err
+		}
+		client.Jar = jar
+	}
+
+	checkRedirect := client.CheckRedirect
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if noRedirect, _ := req.Context().Value(noRedirectKey{}).(bool); noRedirect {
+			return http.ErrUseLastResponse
+		}
+		if checkRedirect != nil {
+			return checkRedirect(req, via)
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+
+	userAgent := options.UserAgent
+	if len(userAgent) == 0 {
+		userAgent = DefaultUserAgent
+	}
+
+	// Paths are the same on every host, so the default config will do
+	config, err := utils.NewConfig(utils.ConfigOption{})
+	if err != nil {
+		return nil, err
+	}
+
+	timeouts := options.Timeouts.withDefaults()
+	client.Transport = &transport{
+		base:         base,
+		userAgent:    userAgent,
+		timeouts:     timeouts.byPath(config.Api),
+		fallback:     timeouts.Default,
+		requestHook:  options.RequestHook,
+		responseHook: options.ResponseHook,
+	}
+
+	return &client, nil
+}
+
+func (timeouts Timeouts) withDefaults() Timeouts {
+	merge := func(value *time.Duration, fallback time.Duration) {
+		switch {
+		case *value == 0:
+			*value = fallback
+		case *value < 0:
+			*value = 0
+		}
+	}
+	merge(&timeouts.SyncCheck, DefaultTimeouts.SyncCheck)
+	merge(&timeouts.SendMsg, DefaultTimeouts.SendMsg)
+	merge(&timeouts.Upload, DefaultTimeouts.Upload)
+	merge(&timeouts.Download, DefaultTimeouts.Download)
+	merge(&timeouts.Default, DefaultTimeouts.Default)
+	return timeouts
+}
+
+// byPath maps the url paths of api to their timeouts.
+func (timeouts Timeouts) byPath(api utils.Api) map[string]time.Duration {
+	byPath := make(map[string]time.Duration)
+	set := func(timeout time.Duration, rawURLs ...string) {
+		for _, rawURL := range rawURLs {
+			byPath[path(rawURL)] = timeout
+		}
+	}
+	set(timeouts.SyncCheck, api.SyncCheck)
+	set(timeouts.SendMsg, api.SendMsg, api.SendMsgImg, api.SendVideoMsg,
+		api.SendAppMsg, api.SendEmoticon)
+	set(timeouts.Upload, api.UploadMedia)
+	set(timeouts.Download, api.GetMsgImg, api.GetVoice, api.GetVideo,
+		api.GetMedia)
+	return byPath
+}
+
+type transport struct {
+	base         http.RoundTripper
+	userAgent    string
+	timeouts     map[string]time.Duration // by url path
+	fallback     time.Duration
+	requestHook  RequestHook
+	responseHook ResponseHook
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := req.Context(), context.CancelFunc(func() {})
+	if timeout := t.timeout(req.URL); timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
+	req = req.Clone(ctx)
+	if len(req.Header.Get("User-Agent")) == 0 {
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	if t.requestHook != nil {
+		t.requestHook(req)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if t.responseHook != nil {
+		t.responseHook(req, resp, err)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// do sends req with core.Client. Errors of failed requests end up in logs,
+// so the query of their url, which carries skey, sid and pass_ticket, is
+// dropped.
+func (core *Core) do(req *http.Request) (*http.Response, error) {
+	resp, err := core.Client.Do(req)
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = withoutQuery(urlErr.URL)
+	}
+	return resp, err
+}
+
+func withoutQuery(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redacted
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+// timeout picks the timeout of the endpoint by path, hosts change with
+// the account.
+func (t *transport) timeout(u *url.URL) time.Duration {
+	if timeout, ok := t.timeouts[u.Path]; ok {
+		return timeout
+	}
+	return t.fallback
+}
+
+func path(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Path
+}
+
+// cancelBody releases the timeout of a request once its body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
@@ -0,0 +1,37 @@
+package wechat
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDoDropsQueryFromErrors(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close() // connections are refused from now on
+
+	core := Core{}
+	client, err := core.newClient(CoreOption{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	core.Client = client
+
+	req, err := http.NewRequest("GET",
+		server.URL+"/cgi-bin/mmwebwx-bin/synccheck?skey=secret&sid=secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = core.do(req)
+	if err == nil {
+		t.Fatal("request to a closed server succeeded")
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("error %q leaks the query", err)
+	}
+	if !strings.Contains(err.Error(), "/synccheck") {
+		t.Errorf("error %q lost the path", err)
+	}
+}
@@ -20,9 +20,10 @@ type AppMessage struct {
 
 var ErrUnknownFileType = errors.New("unknown file type")
 
-func GetDeviceID() string {
-	rand.Seed(time.Now().UnixNano())
-	return fmt.Sprintf("e%.15s", fmt.Sprintf("%0.15f", rand.Float64())[2:17])
+// GetDeviceID returns a device id like the web client generates, "e"
+// followed by 15 digits, drawn from r.
+func GetDeviceID(r *rand.Rand) string {
+	return fmt.Sprintf("e%.15s", fmt.Sprintf("%0.15f", r.Float64())[2:17])
 }
 
 func GetClientMsgId() int64 {
@@ -62,6 +63,22 @@ func DetectMediaType(fileBytes []byte) (*string, error) {
 	return &mediaType, nil
 }
 
+type VideoMessage struct {
+	Size         int
+	PlayLength   int // seconds
+	ThumbMediaId string
+	ThumbSize    int
+	ThumbWidth   int
+	ThumbHeight  int
+}
+
+func GetVideoContent(msg VideoMessage) string {
+	return fmt.Sprintf(`<msg><videomsg length="%d" playlength="%d" `+
+		`cdnthumburl="%s" cdnthumblength="%d" cdnthumbwidth="%d" `+
+		`cdnthumbheight="%d" /></msg>`, msg.Size, msg.PlayLength,
+		msg.ThumbMediaId, msg.ThumbSize, msg.ThumbWidth, msg.ThumbHeight)
+}
+
 func GetAttachmentContent(msg AppMessage) string {
 	// Print the content
 	return fmt.Sprintf(`
@@ -0,0 +1,231 @@
+package wechat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/binarycraft007/wechat/utils"
+)
+
+// posterSize is the longest side of a placeholder poster.
+const posterSize = 320
+
+// VideoInfo is what ParseMP4 reads from the boxes of an MP4 container.
+type VideoInfo struct {
+	Duration time.Duration
+	Width    int
+	Height   int
+	Cover    []byte // image of the covr atom, nil without cover art
+}
+
+// ParseMP4 reads the duration from mvhd, the dimensions from the tkhd of
+// the first visual track and cover art from moov/udta/meta/ilst/covr.
+func ParseMP4(data []byte) (*VideoInfo, error) {
+	moov, ok := findBox(data, "moov")
+	if !ok {
+		return nil, ErrInvalidMP4
+	}
+
+	var info VideoInfo
+
+	mvhd, ok := findBox(moov, "mvhd")
+	if !ok || len(mvhd) < 4 {
+		return nil, ErrInvalidMP4
+	}
+	var timescale, duration uint64
+	if mvhd[0] == 1 { // 64 bit times
+		if len(mvhd) < 32 {
+			return nil, ErrInvalidMP4
+		}
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[20:]))
+		duration = binary.BigEndian.Uint64(mvhd[24:])
+	} else {
+		if len(mvhd) < 20 {
+			return nil, ErrInvalidMP4
+		}
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[12:]))
+		duration = uint64(binary.BigEndian.Uint32(mvhd[16:]))
+	}
+	if timescale > 0 {
+		// Whole seconds first, long 64 bit durations overflow otherwise
+		info.Duration = time.Duration(duration/timescale)*time.Second +
+			time.Duration(duration%timescale)*time.Second/
+				time.Duration(timescale)
+	}
+
+	eachBox(moov, func(boxType string, trak []byte) bool {
+		if boxType != "trak" {
+			return true
+		}
+		tkhd, ok := findBox(trak, "tkhd")
+		if !ok || len(tkhd) < 4 {
+			return true
+		}
+		// width and height are 16.16 fixed point at the end of the box
+		offset := 76
+		if tkhd[0] == 1 {
+			offset = 88
+		}
+		if len(tkhd) < offset+8 {
+			return true
+		}
+		width := int(binary.BigEndian.Uint32(tkhd[offset:]) >> 16)
+		height := int(binary.BigEndian.Uint32(tkhd[offset+4:]) >> 16)
+		if width == 0 || height == 0 { // audio
+			return true
+		}
+		info.Width, info.Height = width, height
+		return false
+	})
+
+	if udta, ok := findBox(moov, "udta"); ok {
+		if meta, ok := findBox(udta, "meta"); ok && len(meta) > 4 {
+			// meta is a full box, its children follow version and flags
+			if ilst, ok := findBox(meta[4:], "ilst"); ok {
+				if covr, ok := findBox(ilst, "covr"); ok {
+					// data holds a type and a locale before the image
+					if data, ok := findBox(covr, "data"); ok && len(data) > 8 {
+						info.Cover = data[8:]
+					}
+				}
+			}
+		}
+	}
+
+	return &info, nil
+}
+
+// Poster returns the cover art stored in the covr atom of the video, or
+// else a generated dark tile with a play button in its aspect ratio. It
+// does not return a frame of the video: that needs an H.264 decoder, and
+// there is none in pure Go, so recipients see the cover art or the tile.
+func (info *VideoInfo) Poster() ([]byte, error) {
+	if len(info.Cover) > 0 {
+		return info.Cover, nil
+	}
+
+	width, height := posterSize, posterSize*3/4
+	if info.Width > 0 && info.Height > 0 {
+		if info.Width >= info.Height {
+			height = maxInt(posterSize*info.Height/info.Width, 1)
+		} else {
+			width = maxInt(posterSize*info.Width/info.Height, 1)
+		}
+	}
+
+	// A play button on dark gray
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	side := minInt(width, height) / 3
+	left, top := (width-side*3/4)/2, (height-side)/2
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.RGBA{0x30, 0x30, 0x30, 0xff}
+			dx, dy := x-left, y-top
+			if dx >= 0 && dy >= 0 && dy < side &&
+				dx <= minInt(dy, side-dy)*3/2 {
+				c = color.RGBA{0xee, 0xee, 0xee, 0xff}
+			}
+			img.Set(x, y, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// addVideoInfo adds the duration, dimensions and an uploaded Poster, cover
+// art or a placeholder rather than a frame, of an MP4 video to messageReq.
+// Without them phones show a black tile, but the video can still be sent,
+// so failures are only logged.
+func (core *Core) addVideoInfo(msg *MediaMessage, messageReq *MessageRequest) {
+	info, err := ParseMP4(msg.FileBytes)
+	if err != nil {
+		core.Logger.Debug("no video metadata", "name", msg.Name, "err", err)
+		return
+	}
+
+	messageReq.PlayLength = int((info.Duration + time.Second - 1) / time.Second)
+	messageReq.ImgWidth, messageReq.ImgHeight = info.Width, info.Height
+
+	poster, err := info.Poster()
+	if err != nil {
+		core.Logger.Warn("video poster failed", "name", msg.Name, "err", err)
+		return
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(poster))
+	if err != nil {
+		core.Logger.Warn("video poster failed", "name", msg.Name, "err", err)
+		return
+	}
+
+	thumb, err := core.UploadMedia(&MediaMessage{
+		Name:      strings.TrimSuffix(msg.Name, filepath.Ext(msg.Name)) + ".jpg",
+		FileBytes: poster,
+	})
+	if err != nil {
+		core.Logger.Warn("video poster upload failed", "name", msg.Name,
+			"err", err)
+		return
+	}
+
+	content := utils.GetVideoContent(utils.VideoMessage{
+		Size:         len(msg.FileBytes),
+		PlayLength:   messageReq.PlayLength,
+		ThumbMediaId: thumb.MediaID,
+		ThumbSize:    len(poster),
+		ThumbWidth:   config.Width,
+		ThumbHeight:  config.Height,
+	})
+	messageReq.Content = &content
+}
+
+// eachBox calls fn with the type and payload of every box in data until
+// fn returns false or a box is malformed.
+func eachBox(data []byte, fn func(boxType string, payload []byte) bool) {
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data))
+		boxType := string(data[4:8])
+		header := uint64(8)
+		switch size {
+		case 0: // extends to the end
+			size = uint64(len(data))
+		case 1: // 64 bit size follows the type
+			if len(data) < 16 {
+				return
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return
+		}
+
+		if !fn(boxType, data[header:size]) {
+			return
+		}
+		data = data[size:]
+	}
+}
+
+func findBox(data []byte, boxType string) ([]byte, bool) {
+	var found []byte
+	ok := false
+	eachBox(data, func(t string, payload []byte) bool {
+		if t == boxType {
+			found, ok = payload, true
+			return false
+		}
+		return true
+	})
+	return found, ok
+}
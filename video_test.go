@@ -0,0 +1,67 @@
+package wechat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseMP4(t *testing.T) {
+	data, err := os.ReadFile("media/gopher.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := ParseMP4(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Duration != 4*time.Second {
+		t.Errorf("duration %v, want 4s", info.Duration)
+	}
+	if info.Width != 640 || info.Height != 640 {
+		t.Errorf("size %dx%d, want 640x640", info.Width, info.Height)
+	}
+	if info.Cover != nil {
+		t.Errorf("cover of %d bytes, want none", len(info.Cover))
+	}
+
+	poster, err := info.Poster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(poster))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "jpeg" || config.Width != config.Height {
+		t.Errorf("poster is a %dx%d %s, want a square jpeg",
+			config.Width, config.Height, format)
+	}
+}
+
+func TestParseMP4LongDuration(t *testing.T) {
+	// A version 1 mvhd of 30 days at a 90kHz timescale
+	mvhd := make([]byte, 32)
+	mvhd[0] = 1
+	binary.BigEndian.PutUint32(mvhd[20:], 90000)
+	binary.BigEndian.PutUint64(mvhd[24:], 30*24*3600*90000)
+
+	info, err := ParseMP4(box("moov", box("mvhd", mvhd)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 30 * 24 * time.Hour; info.Duration != want {
+		t.Errorf("duration %v, want %v", info.Duration, want)
+	}
+}
+
+func box(boxType string, payload []byte) []byte {
+	data := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(data, uint32(8+len(payload)))
+	copy(data[4:], boxType)
+	return append(data, payload...)
+}